@@ -0,0 +1,302 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mozilla/mig"
+)
+
+// Split a self-service loader name into the owner and slot number
+func parseLoaderName(name string) (owner string, slot int, err error) {
+	if !strings.HasPrefix(name, "migss-") {
+		return "", 0, fmt.Errorf("not a self-service loader")
+	}
+	ri := strings.LastIndex(name, "-")
+	if ri <= len("migss-") {
+		return "", 0, fmt.Errorf("loader name has no owner")
+	}
+	owner = name[len("migss-"):ri]
+	r := requestDetails{remoteUser: owner}
+	slot, err = r.loaderSlot(name)
+	if err != nil {
+		return "", 0, err
+	}
+	return owner, slot, nil
+}
+
+// Returns true if user is permitted to access the administrative interface
+func isAdmin(user string) bool {
+	for _, x := range cfg.AdminUsers {
+		if x == user {
+			return true
+		}
+	}
+	for _, g := range userGroups(user) {
+		for _, x := range cfg.AdminGroups {
+			if x == g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Wraps handlers for the administrative interface, rejecting requests from users
+// that are not administrators
+func adminOnly(h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rdetails, err := newRequestDetails(req)
+		if err != nil {
+			writeError(rw, req, errUnauthorized("no valid identity for request", err))
+			return
+		}
+		if !isAdmin(rdetails.remoteUser) {
+			auditor.failure(newAuditEvent(req, rdetails.remoteUser, auditAdminDenied),
+				fmt.Errorf("%v %v", req.Method, req.URL.Path))
+			writeError(rw, req, errForbidden("administrative access required", nil))
+			return
+		}
+		h(rw, req)
+	}
+}
+
+// A self-service loader entry as shown in the administrative interface
+type adminLoader struct {
+	ID        float64   `json:"id"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Slot      int       `json:"slot"`
+	Enabled   bool      `json:"enabled"`
+	LastSeen  time.Time `json:"lastseen"`
+	AgentName string    `json:"agentname"`
+}
+
+// Response to an administrative loader listing request
+type adminLoadersReply struct {
+	Loaders []adminLoader `json:"loaders"`
+}
+
+// Payload submitted for administrative loader changes
+type adminLoaderRequest struct {
+	ID float64 `json:"id"`
+}
+
+// Return all self-service loaders, skipping any with a name that does not follow
+// the self-service naming convention
+func allSelfServiceLoaders(cli migClient) (ret []adminLoader, err error) {
+	ldrs, err := searchLoaders(cli, "migss-%")
+	if err != nil {
+		return
+	}
+	for _, le := range ldrs {
+		owner, slot, err := parseLoaderName(le.Name)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, adminLoader{
+			ID:        le.ID,
+			Name:      le.Name,
+			Owner:     owner,
+			Slot:      slot,
+			Enabled:   le.Enabled,
+			LastSeen:  le.LastSeen,
+			AgentName: le.AgentName,
+		})
+	}
+	return
+}
+
+// Locate a self-service loader entry using the loader ID
+func findSelfServiceLoader(cli migClient, id float64) (mig.LoaderEntry, error) {
+	ldrs, err := searchLoaders(cli, "migss-%")
+	if err != nil {
+		return mig.LoaderEntry{}, errMIG(err)
+	}
+	for _, le := range ldrs {
+		if le.ID != id {
+			continue
+		}
+		_, _, err = parseLoaderName(le.Name)
+		if err != nil {
+			break
+		}
+		return le, nil
+	}
+	return mig.LoaderEntry{}, errNotFound(fmt.Sprintf("self-service loader %.0f not found", id), nil)
+}
+
+func handleAdmin(rw http.ResponseWriter, req *http.Request) {
+	rdetails, err := newRequestDetails(req)
+	if err != nil {
+		writeError(rw, req, errUnauthorized("no valid identity for request", err))
+		return
+	}
+	rdetails.csrfToken, err = csrfToken(rw, req, rdetails.remoteUser)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	ap, err := renderAdminPage(rdetails)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	fmt.Fprint(rw, ap)
+}
+
+func handleAdminLoaders(rw http.ResponseWriter, req *http.Request) {
+	var stale time.Duration
+	user := strings.ToLower(req.FormValue("user"))
+	if sv := req.FormValue("stale"); sv != "" {
+		days, err := strconv.Atoi(sv)
+		if err != nil || days < 0 {
+			writeError(rw, req, errBadRequest("invalid stale value", err))
+			return
+		}
+		stale = time.Duration(days) * 24 * time.Hour
+	}
+	cli, err := newMIGClient(req.Context())
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	ldrs, err := allSelfServiceLoaders(cli)
+	if err != nil {
+		writeError(rw, req, errMIG(err))
+		return
+	}
+	resp := adminLoadersReply{Loaders: make([]adminLoader, 0)}
+	for _, x := range ldrs {
+		if user != "" && !strings.Contains(strings.ToLower(x.Owner), user) {
+			continue
+		}
+		if stale != 0 && time.Since(x.LastSeen) < stale {
+			continue
+		}
+		resp.Loaders = append(resp.Loaders, x)
+	}
+	buf, err := json.Marshal(&resp)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(rw, string(buf))
+}
+
+func handleAdminDisable(rw http.ResponseWriter, req *http.Request) {
+	var alr adminLoaderRequest
+
+	rdetails, err := newRequestDetails(req)
+	if err != nil {
+		writeError(rw, req, errUnauthorized("no valid identity for request", err))
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	defer req.Body.Close()
+	err = decoder.Decode(&alr)
+	if err != nil {
+		writeError(rw, req, errBadRequest("invalid request", err))
+		return
+	}
+	ctx, cancel := keyOpContext(req)
+	defer cancel()
+	cli, err := newMIGClient(ctx)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	le, err := findSelfServiceLoader(cli, alr.ID)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+	owner, _, _ := parseLoaderName(le.Name)
+	release, err := lockUserKeys(owner)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+	defer release()
+	ev := newAuditEvent(req, rdetails.remoteUser, auditDisable)
+	ev.setLoader(le)
+	err = cli.LoaderEntryStatus(le, false)
+	if err != nil {
+		auditor.failure(ev, err)
+		writeError(rw, req, errMIG(err))
+		return
+	}
+	auditor.success(ev)
+}
+
+func handleAdminRekey(rw http.ResponseWriter, req *http.Request) {
+	var alr adminLoaderRequest
+
+	rdetails, err := newRequestDetails(req)
+	if err != nil {
+		writeError(rw, req, errUnauthorized("no valid identity for request", err))
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	defer req.Body.Close()
+	err = decoder.Decode(&alr)
+	if err != nil {
+		writeError(rw, req, errBadRequest("invalid request", err))
+		return
+	}
+	ctx, cancel := keyOpContext(req)
+	defer cancel()
+	cli, err := newMIGClient(ctx)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	le, err := findSelfServiceLoader(cli, alr.ID)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+	owner, _, _ := parseLoaderName(le.Name)
+	release, err := lockUserKeys(owner)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+	defer release()
+	ev := newAuditEvent(req, rdetails.remoteUser, auditRekey)
+	ev.setLoader(le)
+	newle, err := rekeyLoader(cli, le, &ev)
+	if err != nil {
+		auditor.failure(ev, err)
+		writeError(rw, req, err)
+		return
+	}
+	auditor.success(ev)
+	reaper.keyIssued(newle.Name)
+	// As with keys issued to users, the key is kept in the vault and retrieved
+	// once by the administrator using the token
+	var reply newkeyReply
+	reply.Name = newle.Name
+	reply.Token, reply.Expires, err = vault.put(rdetails.remoteUser, newle)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	buf, err := json.Marshal(&reply)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(rw, string(buf))
+}
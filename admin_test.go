@@ -0,0 +1,114 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mozilla/mig"
+)
+
+func TestAdminRekey(t *testing.T) {
+	b := useMemoryBackend(t)
+	if err := vaultInit(); err != nil {
+		t.Fatal(err)
+	}
+	le, err := b.PostNewLoader(mig.LoaderEntry{Name: "migss-user@example.com-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/rekey", setContext(handleAdminRekey))
+	r.HandleFunc("/key/{token}", setContext(handleGetKey))
+	rw := serveAs(t, r, "admin@example.com", "POST", "/admin/rekey", fmt.Sprintf(`{"id":%.0f}`, le.ID))
+	if rw.Code != 200 {
+		t.Fatalf("rekey: got %v %v", rw.Code, rw.Body.String())
+	}
+	var reply newkeyReply
+	err = json.Unmarshal(rw.Body.Bytes(), &reply)
+	if err != nil || reply.Token == "" || reply.Name != le.Name {
+		t.Fatalf("rekey: unexpected response %v", rw.Body.String())
+	}
+	if strings.Contains(rw.Body.String(), `"key"`) || strings.Contains(rw.Body.String(), `"prefix"`) {
+		t.Fatalf("rekey response includes the key: %v", rw.Body.String())
+	}
+	if !b.Loaders()[0].Enabled {
+		t.Fatal("rekeyed loader is not enabled")
+	}
+
+	// The key can only be retrieved by the administrator that rekeyed the entry,
+	// and only once
+	rw = serveAs(t, r, "user@example.com", "GET", "/key/"+reply.Token, "")
+	if rw.Code != 404 {
+		t.Fatalf("key retrieved by another user: got %v", rw.Code)
+	}
+	rw = serveAs(t, r, "admin@example.com", "GET", "/key/"+reply.Token, "")
+	var kr keyReply
+	if rw.Code != 200 || json.Unmarshal(rw.Body.Bytes(), &kr) != nil {
+		t.Fatalf("key retrieval: got %v %v", rw.Code, rw.Body.String())
+	}
+	if err = mig.ValidateLoaderPrefixAndKey(kr.Key); err != nil {
+		t.Fatalf("retrieved invalid key %q: %v", kr.Key, err)
+	}
+	rw = serveAs(t, r, "admin@example.com", "GET", "/key/"+reply.Token, "")
+	if rw.Code != 404 {
+		t.Fatalf("key retrieved twice: got %v", rw.Code)
+	}
+}
+
+// An administrator's change to an entry waits for a key operation in progress for
+// the entry's owner
+func TestAdminWaitsForOwner(t *testing.T) {
+	b := useMemoryBackend(t)
+	useMemoryStore(t)
+	if err := vaultInit(); err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/disable", setContext(handleAdminDisable))
+	r.HandleFunc("/admin/rekey", setContext(handleAdminRekey))
+	for _, path := range []string{"/admin/rekey", "/admin/disable"} {
+		le, err := b.PostNewLoader(mig.LoaderEntry{Name: "migss-user@example.com-1"})
+		if err == nil {
+			err = b.LoaderEntryStatus(le, true)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix := b.Loaders()[len(b.Loaders())-1].Prefix
+
+		// Hold the lock as the owner's own key operation would
+		release, err := lockUserKeys("user@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan int)
+		go func() {
+			rw := serveAs(t, r, "admin@example.com", "POST", path, fmt.Sprintf(`{"id":%.0f}`, le.ID))
+			done <- rw.Code
+		}()
+		select {
+		case code := <-done:
+			t.Fatalf("%v completed during the owner's key operation: got %v", path, code)
+		case <-time.After(50 * time.Millisecond):
+		}
+		cur := b.Loaders()[len(b.Loaders())-1]
+		if !cur.Enabled || cur.Prefix != prefix {
+			t.Fatalf("%v changed the entry during the owner's key operation", path)
+		}
+		release()
+		if code := <-done; code != 200 {
+			t.Fatalf("%v: got %v", path, code)
+		}
+		b.LoaderEntryStatus(le, false)
+	}
+}
@@ -0,0 +1,385 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The versioned JSON API, served under apiPrefix. Each route is described in
+// apiRoutes, which is used both to register the handlers and to generate the
+// OpenAPI document served at /api/v1/openapi.json, so the two can't disagree.
+
+const apiPrefix = "/api/v1"
+
+// Largest request body accepted by the API
+const maxAPIRequest = 64 * 1024
+
+// Status of a slot
+const (
+	slotUnassigned = "unassigned" // No key has been issued for the slot
+	slotActive     = "active"     // The slot holds an enabled key
+	slotDisabled   = "disabled"   // The key for the slot has been disabled
+)
+
+type apiAgent struct {
+	Hostname  string    `json:"hostname" doc:"Hostname of the agent"`
+	OS        string    `json:"os" doc:"Operating system of the agent"`
+	Arch      string    `json:"arch" doc:"Architecture of the agent"`
+	Version   string    `json:"version" doc:"Version of the agent"`
+	HeartBeat time.Time `json:"heartbeat" doc:"Time of the most recent heartbeat from the agent"`
+	Status    string    `json:"status" doc:"Status of the agent"`
+}
+
+type apiSlot struct {
+	Slot      int        `json:"slot" doc:"Slot number"`
+	Status    string     `json:"status" doc:"One of unassigned, active or disabled"`
+	Loader    string     `json:"loader,omitempty" doc:"Name of the loader entry for the slot"`
+	LastUsed  *time.Time `json:"last_used,omitempty" doc:"Time the key was last used"`
+	Agent     *apiAgent  `json:"agent,omitempty" doc:"The most recent agent enrolled using the key"`
+	OverQuota bool       `json:"over_quota,omitempty" doc:"The slot is above the user's quota, so its key can be removed but not replaced"`
+}
+
+type apiSlotList struct {
+	Slots []apiSlot `json:"slots" doc:"Each of the user's slots"`
+}
+
+type apiKeyRequest struct {
+	Replace bool `json:"replace,omitempty" doc:"Replace the key if the slot already holds an active key"`
+}
+
+type apiKeyIssued struct {
+	Slot        int       `json:"slot" doc:"Slot number"`
+	Loader      string    `json:"loader" doc:"Name of the loader entry for the slot"`
+	Token       string    `json:"token" doc:"Token used to retrieve the key, once"`
+	Expires     time.Time `json:"expires" doc:"Time after which the key can no longer be retrieved"`
+	KeyURL      string    `json:"key_url" doc:"Path returning the key as JSON"`
+	DownloadURL string    `json:"download_url" doc:"Path returning the key as a mig-loader.key file"`
+}
+
+type apiMe struct {
+	User  string `json:"user" doc:"The authenticated user"`
+	Slots int    `json:"slots" doc:"Number of slots available to the user"`
+	Admin bool   `json:"admin" doc:"True if the user can use the administrative interface"`
+}
+
+// A route in the API. request and response are zero values of the request body and
+// response types; request is nil if the route takes no body and response is nil if
+// the route returns no content.
+type apiRoute struct {
+	method   string
+	path     string
+	summary  string
+	request  interface{}
+	response interface{}
+	status   int
+	scope    string // Scope an access token needs to use the route
+	keyOp    bool   // The route changes loader entries
+	handler  func(req *http.Request, rdetails *requestDetails, body interface{}) (interface{}, error)
+}
+
+var apiRoutes = []apiRoute{
+	{
+		method:   "GET",
+		path:     "/me",
+		summary:  "Describe the authenticated user",
+		response: apiMe{},
+		status:   http.StatusOK,
+		scope:    scopeStatus,
+		handler:  apiGetMe,
+	},
+	{
+		method:   "GET",
+		path:     "/slots",
+		summary:  "List the user's slots",
+		response: apiSlotList{},
+		status:   http.StatusOK,
+		scope:    scopeStatus,
+		handler:  apiListSlots,
+	},
+	{
+		method:   "GET",
+		path:     "/slots/{n}",
+		summary:  "Describe a slot",
+		response: apiSlot{},
+		status:   http.StatusOK,
+		scope:    scopeStatus,
+		handler:  apiGetSlot,
+	},
+	{
+		method:   "POST",
+		path:     "/slots/{n}/key",
+		summary:  "Issue a key for a slot",
+		request:  apiKeyRequest{},
+		response: apiKeyIssued{},
+		status:   http.StatusOK,
+		scope:    scopeKeys,
+		keyOp:    true,
+		handler:  apiIssueKey,
+	},
+	{
+		method:  "DELETE",
+		path:    "/slots/{n}/key",
+		summary: "Disable the key for a slot",
+		status:  http.StatusNoContent,
+		scope:   scopeKeys,
+		keyOp:   true,
+		handler: apiRemoveKey,
+	},
+}
+
+// Returns true if the media type in header v, which may include parameters, is
+// application/json
+func isJSONType(v string) bool {
+	mt, _, err := mime.ParseMediaType(v)
+	return err == nil && mt == "application/json"
+}
+
+// Returns true if the Accept header permits a JSON response
+func acceptsJSON(req *http.Request) bool {
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, x := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(x))
+		if err != nil {
+			continue
+		}
+		if mt == "application/json" || mt == "application/*" || mt == "*/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Wraps API handlers, checking the request can be handled before it is passed on.
+// Requests that change state must be JSON; browsers will not send JSON to another
+// origin without a CORS preflight, which the portal does not permit, and if the
+// request does carry an origin it must be the portal's own.
+func apiCheck(h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if !acceptsJSON(req) {
+			writeError(rw, req, errNotAcceptable("responses are only available as application/json"))
+			return
+		}
+		if req.Method == "GET" || req.Method == "HEAD" {
+			h(rw, req)
+			return
+		}
+		if req.Method == "POST" && !isJSONType(req.Header.Get("Content-Type")) {
+			writeError(rw, req, errUnsupportedType("request body must be application/json"))
+			return
+		}
+		if req.Header.Get("Origin") != "" {
+			err := csrfCheckOrigin(req)
+			if err != nil {
+				writeError(rw, req, errForbidden("the request origin is not permitted", err))
+				return
+			}
+		}
+		h(rw, req)
+	}
+}
+
+// Handle a request for the route, decoding the request body, calling the route's
+// handler and encoding the response
+func (a apiRoute) serve(rw http.ResponseWriter, req *http.Request) {
+	rdetails, err := newRequestDetails(req)
+	if err != nil {
+		writeError(rw, req, errUnauthorized("no valid identity for request", err))
+		return
+	}
+	var body interface{}
+	if a.request != nil {
+		bp := reflect.New(reflect.TypeOf(a.request))
+		dec := json.NewDecoder(io.LimitReader(req.Body, maxAPIRequest))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(bp.Interface())
+		// An empty body is treated as a request with every field unset
+		if err != nil && err != io.EOF {
+			writeError(rw, req, errBadRequest("invalid request body", err))
+			return
+		}
+		body = bp.Elem().Interface()
+	}
+	ret, err := a.handler(req, &rdetails, body)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+	if a.response == nil {
+		rw.WriteHeader(a.status)
+		return
+	}
+	if reflect.TypeOf(ret) != reflect.TypeOf(a.response) {
+		writeError(rw, req, errInternal(fmt.Errorf("%v %v returned %T, expected %T",
+			a.method, a.path, ret, a.response)))
+		return
+	}
+	buf, err := json.Marshal(ret)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(a.status)
+	rw.Write(buf)
+}
+
+// Register the API routes with r, generating the OpenAPI document describing them
+func addAPIRoutes(r *mux.Router) error {
+	var err error
+	openAPIDoc, err = encodeOpenAPI(apiRoutes)
+	if err != nil {
+		return fmt.Errorf("generating OpenAPI document: %v", err)
+	}
+	s := r.PathPrefix(apiPrefix).Subrouter()
+	s.HandleFunc("/openapi.json", handleOpenAPI).Methods("GET")
+	for _, a := range apiRoutes {
+		h := a.serve
+		if a.keyOp {
+			h = rateLimit(trackKeyOp(serializeKeyOp(h)))
+		}
+		s.HandleFunc(a.path, setTokenContext(a.scope, apiCheck(h))).Methods(a.method)
+	}
+	return nil
+}
+
+// Return the slot number in the request, checking it is one of the user's slots.
+// Slots above the user's quota are only accepted if inQuota is false.
+func requestSlot(req *http.Request, rdetails *requestDetails, inQuota bool) (int, error) {
+	n, err := strconv.Atoi(mux.Vars(req)["n"])
+	if err != nil || n < 1 || (inQuota && n > rdetails.slots) {
+		return 0, errNotFound("no such slot", err)
+	}
+	return n, nil
+}
+
+// Return the user's slots, looking up the loader entry and agent for each. Slots above
+// the user's quota are included if they still hold an active key.
+func userSlots(req *http.Request, rdetails *requestDetails) ([]apiSlot, error) {
+	cli, err := newMIGClient(req.Context())
+	if err != nil {
+		return nil, errInternal(err)
+	}
+	err = rdetails.addKeys(cli)
+	if err != nil {
+		return nil, errMIG(err)
+	}
+	agents := make(map[int]slotAgent)
+	for _, x := range rdetails.slotAgents(cli) {
+		agents[x.Slot] = x
+	}
+	last := rdetails.slots
+	for _, le := range rdetails.loaders {
+		if n, err := rdetails.loaderSlot(le.Name); err == nil && le.Enabled && n > last {
+			last = n
+		}
+	}
+	ret := make([]apiSlot, 0, last)
+	for i := 1; i <= last; i++ {
+		s := apiSlot{Slot: i, Status: slotUnassigned, OverQuota: i > rdetails.slots}
+		le, found, err := rdetails.slotLoader(rdetails.slotName(i))
+		if err != nil {
+			return nil, err
+		}
+		if s.OverQuota && (!found || !le.Enabled) {
+			continue
+		}
+		if found {
+			s.Loader = le.Name
+			s.Status = slotDisabled
+			if le.Enabled {
+				s.Status = slotActive
+			}
+			if !le.LastSeen.IsZero() {
+				ls := le.LastSeen
+				s.LastUsed = &ls
+			}
+			if agt, ok := agents[i]; ok {
+				s.Agent = &apiAgent{
+					Hostname:  agt.Hostname,
+					OS:        agt.OS,
+					Arch:      agt.Arch,
+					Version:   agt.Version,
+					HeartBeat: agt.HeartBeatTS,
+					Status:    agt.Status,
+				}
+			}
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+func apiGetMe(req *http.Request, rdetails *requestDetails, body interface{}) (interface{}, error) {
+	return apiMe{User: rdetails.remoteUser, Slots: rdetails.slots, Admin: isAdmin(rdetails.remoteUser)}, nil
+}
+
+func apiListSlots(req *http.Request, rdetails *requestDetails, body interface{}) (interface{}, error) {
+	slots, err := userSlots(req, rdetails)
+	if err != nil {
+		return nil, err
+	}
+	return apiSlotList{Slots: slots}, nil
+}
+
+func apiGetSlot(req *http.Request, rdetails *requestDetails, body interface{}) (interface{}, error) {
+	n, err := requestSlot(req, rdetails, false)
+	if err != nil {
+		return nil, err
+	}
+	slots, err := userSlots(req, rdetails)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range slots {
+		if s.Slot == n {
+			return s, nil
+		}
+	}
+	return nil, errNotFound("no such slot", nil)
+}
+
+func apiIssueKey(req *http.Request, rdetails *requestDetails, body interface{}) (interface{}, error) {
+	n, err := requestSlot(req, rdetails, true)
+	if err != nil {
+		return nil, err
+	}
+	kr := body.(apiKeyRequest)
+	reply, err := issueKey(req, rdetails, rdetails.slotName(n), kr.Replace)
+	if err != nil {
+		return nil, err
+	}
+	return apiKeyIssued{
+		Slot:        n,
+		Loader:      reply.Name,
+		Token:       reply.Token,
+		Expires:     reply.Expires,
+		KeyURL:      "/key/" + reply.Token,
+		DownloadURL: "/key/" + reply.Token + "/download",
+	}, nil
+}
+
+func apiRemoveKey(req *http.Request, rdetails *requestDetails, body interface{}) (interface{}, error) {
+	n, err := requestSlot(req, rdetails, false)
+	if err != nil {
+		return nil, err
+	}
+	return nil, removeKey(req, rdetails, rdetails.slotName(n))
+}
@@ -0,0 +1,61 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mozilla/mig"
+)
+
+// An active key in a slot above a lowered quota is listed and can be removed, but
+// not replaced
+func TestAPIOverQuotaSlots(t *testing.T) {
+	b := useMemoryBackend(t)
+	useMemoryStore(t)
+	user := "user@example.com"
+	for _, slot := range []string{"2", "3"} {
+		le, err := b.PostNewLoader(mig.LoaderEntry{Name: "migss-" + user + "-" + slot})
+		if err == nil {
+			err = b.LoaderEntryStatus(le, true)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := cfg.UserSlotQuota
+	cfg.UserSlotQuota = map[string]int{user: 1}
+	t.Cleanup(func() { cfg.UserSlotQuota = old })
+	r := mux.NewRouter()
+	if err := addAPIRoutes(r); err != nil {
+		t.Fatal(err)
+	}
+
+	rw := serveAs(t, r, user, "GET", apiPrefix+"/slots", "")
+	var list apiSlotList
+	if rw.Code != 200 || json.Unmarshal(rw.Body.Bytes(), &list) != nil {
+		t.Fatalf("list slots: got %v %v", rw.Code, rw.Body.String())
+	}
+	if len(list.Slots) != 3 || list.Slots[0].OverQuota || !list.Slots[2].OverQuota ||
+		list.Slots[2].Slot != 3 || list.Slots[2].Status != slotActive {
+		t.Fatalf("list slots: got %+v", list.Slots)
+	}
+	rw = serveAs(t, r, user, "POST", apiPrefix+"/slots/3/key", "{}", "Content-Type", "application/json")
+	if rw.Code != 404 {
+		t.Fatalf("issue key above the quota: got %v %v", rw.Code, rw.Body.String())
+	}
+	rw = serveAs(t, r, user, "DELETE", apiPrefix+"/slots/3/key", "")
+	if rw.Code != 204 {
+		t.Fatalf("remove key above the quota: got %v %v", rw.Code, rw.Body.String())
+	}
+	// Once disabled the slot is no longer listed
+	rw = serveAs(t, r, user, "GET", apiPrefix+"/slots/3", "")
+	if rw.Code != 404 {
+		t.Fatalf("get disabled slot above the quota: got %v %v", rw.Code, rw.Body.String())
+	}
+}
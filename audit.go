@@ -0,0 +1,264 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mozilla/mig"
+)
+
+// Audit log configuration; Sinks lists where events are written and can include
+// file, syslog and stdout. If no sinks are configured events are written to stdout.
+type auditConfig struct {
+	Sinks     []string
+	File      string // Path to the audit log for the file sink
+	SyslogTag string // Tag used for the syslog sink, default mig-selfservice
+}
+
+// Actions recorded in the audit log
+const (
+	auditCreate      = "create"
+	auditRekey       = "rekey"
+	auditDisable     = "disable"
+	auditAuthFailure = "authfailure"
+	auditCSRFFailure = "csrffailure"
+	auditAdminDenied = "admindenied"
+	auditExpire      = "expire"
+	auditRateLimited = "ratelimited"
+	auditTokenCreate = "tokencreate"
+	auditTokenRevoke = "tokenrevoke"
+	auditTokenUse    = "tokenuse"
+)
+
+// Outcomes recorded in the audit log
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+)
+
+// An event written to the audit log
+type auditEvent struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Action     string    `json:"action"`
+	Outcome    string    `json:"outcome"`
+	RemoteUser string    `json:"remoteuser,omitempty"`
+	SourceIP   string    `json:"sourceip,omitempty"`
+	Owner      string    `json:"owner,omitempty"`
+	Slot       int       `json:"slot,omitempty"`
+	LoaderID   float64   `json:"loaderid,omitempty"`
+	LoaderName string    `json:"loadername,omitempty"`
+	TokenID    string    `json:"tokenid,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	DryRun     bool      `json:"dryrun,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Create a new audit event for a request
+func newAuditEvent(req *http.Request, user string, action string) auditEvent {
+	return auditEvent{
+		Timestamp:  time.Now().UTC(),
+		Action:     action,
+		RemoteUser: user,
+		SourceIP:   clientIP(req),
+	}
+}
+
+// Return the path of the request for logging. The template of the matched route is
+// used, so values in the path such as the token used to retrieve a key are not
+// recorded.
+func routePath(req *http.Request) string {
+	if r := mux.CurrentRoute(req); r != nil {
+		if tpl, err := r.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return "(no route)"
+}
+
+// Create a new audit event for an action taken by the portal itself rather than
+// in response to a request
+func newSystemAuditEvent(action string) auditEvent {
+	return auditEvent{
+		Timestamp: time.Now().UTC(),
+		Action:    action,
+	}
+}
+
+// Add details of the loader entry to the event
+func (a *auditEvent) setLoader(le mig.LoaderEntry) {
+	a.LoaderID = le.ID
+	a.LoaderName = le.Name
+	a.Owner, a.Slot, _ = parseLoaderName(le.Name)
+}
+
+// Return the address of the client that made the request. If the request was
+// received from a configured trusted proxy, X-Forwarded-For is used. Each proxy
+// appends the address it received the request from, and the client can put
+// anything it likes at the start of the header, so the entries are checked from
+// the right and the first address that is not a trusted proxy is used.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if len(trust.nets) == 0 || !trust.trustedSource(req) {
+		return host
+	}
+	var hops []string
+	for _, v := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !trust.trustedAddr(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+// A destination audit events are written to
+type auditSink interface {
+	write([]byte) error
+}
+
+// Where the stdout sink writes events
+var auditStdout io.Writer = os.Stdout
+
+type auditStdoutSink struct{}
+
+func (s *auditStdoutSink) write(buf []byte) error {
+	_, err := auditStdout.Write(append(buf, '\n'))
+	return err
+}
+
+type auditFileSink struct {
+	fd *os.File
+}
+
+func newAuditFileSink(path string) (*auditFileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("audit file sink requires a path")
+	}
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditFileSink{fd: fd}, nil
+}
+
+func (s *auditFileSink) write(buf []byte) error {
+	_, err := s.fd.Write(append(buf, '\n'))
+	if err != nil {
+		return err
+	}
+	return s.fd.Sync()
+}
+
+type auditSyslogSink struct {
+	w *syslog.Writer
+}
+
+func newAuditSyslogSink(tag string) (*auditSyslogSink, error) {
+	if tag == "" {
+		tag = "mig-selfservice"
+	}
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &auditSyslogSink{w: w}, nil
+}
+
+func (s *auditSyslogSink) write(buf []byte) error {
+	return s.w.Info(string(buf))
+}
+
+type auditLog struct {
+	sync.Mutex
+	sinks []auditSink
+}
+
+var auditor auditLog
+
+// Initialize the audit log sinks from the configuration
+func (a *auditLog) init(conf auditConfig) error {
+	sinks := conf.Sinks
+	if len(sinks) == 0 {
+		sinks = []string{"stdout"}
+	}
+	for _, x := range sinks {
+		var (
+			s   auditSink
+			err error
+		)
+		switch x {
+		case "stdout":
+			s = &auditStdoutSink{}
+		case "file":
+			s, err = newAuditFileSink(conf.File)
+		case "syslog":
+			s, err = newAuditSyslogSink(conf.SyslogTag)
+		default:
+			err = fmt.Errorf("unknown audit sink %q", x)
+		}
+		if err != nil {
+			return err
+		}
+		a.sinks = append(a.sinks, s)
+	}
+	return nil
+}
+
+// Write an event to each configured sink
+func (a *auditLog) record(ev auditEvent) {
+	buf, err := json.Marshal(&ev)
+	if err != nil {
+		log.Printf("error: unable to marshal audit event: %v", err)
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	for _, s := range a.sinks {
+		err = s.write(buf)
+		if err != nil {
+			// If we can't write to the sink, at least make sure the event
+			// ends up somewhere
+			log.Printf("error: audit sink write failed: %v: %s", err, buf)
+		}
+	}
+}
+
+// Record a successful event
+func (a *auditLog) success(ev auditEvent) {
+	ev.Outcome = auditSuccess
+	a.record(ev)
+}
+
+// Record a failed event, including the error that caused the failure
+func (a *auditLog) failure(ev auditEvent, err error) {
+	ev.Outcome = auditFailure
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	a.record(ev)
+}
@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// Trust proxies in the supplied networks for the duration of the test
+func useTrustedProxies(t *testing.T, cidrs ...string) {
+	old := trust
+	err := trust.init(proxyConfig{TrustedCIDRs: cidrs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { trust = old })
+}
+
+func TestClientIP(t *testing.T) {
+	useTrustedProxies(t, "10.0.0.0/8")
+	tests := []struct {
+		remote string
+		xff    []string
+		want   string
+	}{
+		// Not from a trusted proxy, so the header is ignored
+		{"192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		// Entries added by the client to the left of the real address are ignored
+		{"10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.9", "198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"10.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"garbage, 10.0.0.2"}, "garbage"},
+		// Only trusted proxies, so the furthest one is used
+		{"10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		for _, v := range tt.xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(req); got != tt.want {
+			t.Errorf("clientIP(%v, %q) = %v, want %v", tt.remote, tt.xff, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Returned instead of making a request while the circuit breaker is open
+var errBreakerOpen = fmt.Errorf("MIG API circuit breaker is open, not contacting the API")
+
+// States of the circuit breaker
+const (
+	breakerClosed   = "closed"    // Requests are made normally
+	breakerOpen     = "open"      // Requests fail without contacting the API
+	breakerHalfOpen = "half-open" // A single request is made to test the API
+)
+
+// A circuit breaker for requests to the MIG API. After threshold consecutive
+// requests fail to reach the API, requests fail immediately for the cooldown period
+// rather than each waiting to time out. Once the cooldown expires a single request
+// is let through; if it succeeds the breaker closes again.
+type circuitBreaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, state: breakerClosed}
+}
+
+// Returns nil if a request can be made, or errBreakerOpen if not. If nil is
+// returned the result of the request must be reported using record or abandon.
+func (c *circuitBreaker) allow() error {
+	c.Lock()
+	defer c.Unlock()
+	switch c.state {
+	case breakerOpen:
+		if time.Since(c.openedAt) < c.cooldown {
+			return errBreakerOpen
+		}
+		c.state = breakerHalfOpen
+		c.probing = true
+		return nil
+	case breakerHalfOpen:
+		if c.probing {
+			return errBreakerOpen
+		}
+		c.probing = true
+	}
+	return nil
+}
+
+// Record the result of a request. failed should be true only if the request failed
+// because the API could not be reached or was unable to handle it.
+func (c *circuitBreaker) record(failed bool) {
+	c.Lock()
+	defer c.Unlock()
+	if !failed {
+		if c.state != breakerClosed {
+			log.Printf("MIG API circuit breaker closed")
+		}
+		c.state = breakerClosed
+		c.failures = 0
+		c.probing = false
+		return
+	}
+	c.failures++
+	if c.state == breakerHalfOpen || c.failures >= c.threshold {
+		if c.state != breakerOpen {
+			log.Printf("MIG API circuit breaker opened after %v failures", c.failures)
+		}
+		c.state = breakerOpen
+		c.openedAt = time.Now()
+		c.probing = false
+	}
+}
+
+// Record that a request was abandoned by the caller before its outcome was known,
+// which says nothing about the API. If the request was the probe made while half
+// open another probe is allowed.
+func (c *circuitBreaker) abandon() {
+	c.Lock()
+	defer c.Unlock()
+	c.probing = false
+}
+
+// Return the current state of the breaker
+func (c *circuitBreaker) current() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.state
+}
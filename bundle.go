@@ -0,0 +1,247 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mozilla/mig"
+)
+
+// Installer bundles hold the key issued to the user along with a script that
+// installs MIG using it. If InstallerCache is configured and holds a copy of the
+// installer it is included in the bundle, otherwise the script downloads it.
+
+// The directory files are placed in within a bundle
+const bundleDir = "mig-install"
+
+// A file included in a bundle, with contents either held in data or read from
+// the file at path
+type bundleFile struct {
+	name string
+	mode int64
+	data []byte
+	path string
+	size int64
+}
+
+func (b *bundleFile) open() (io.ReadCloser, error) {
+	if b.path != "" {
+		return os.Open(b.path)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b.data)), nil
+}
+
+// Return a bundle file for the cached copy of inst, or found false if there is no
+// cached copy
+func cachedInstaller(inst installerRef) (ret bundleFile, found bool) {
+	if cfg.InstallerCache == "" {
+		return
+	}
+	p := filepath.Join(cfg.InstallerCache, inst.File)
+	fi, err := os.Stat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+	return bundleFile{name: inst.File, mode: 0644, path: p, size: fi.Size()}, true
+}
+
+// Describes how the bundle for an operating system is built
+type bundleKind struct {
+	filename string
+	zip      bool
+	// Return the installers for the operating system from data
+	installers func(data installData) []installerRef
+	// Return the install scripts for the operating system
+	scripts func(data installData) ([]bundleFile, error)
+}
+
+func scriptFile(name string, tmpl string, data installData) (bundleFile, error) {
+	buf, err := renderInstallScript(name, tmpl, data)
+	return bundleFile{name: name, mode: 0755, data: buf}, err
+}
+
+var bundleKinds = map[string]bundleKind{
+	"linux": {
+		filename: "mig-install-linux.tar.gz",
+		installers: func(data installData) []installerRef {
+			return []installerRef{data.RPM, data.DEB}
+		},
+		scripts: func(data installData) ([]bundleFile, error) {
+			f, err := scriptFile("install.sh", linuxInstallTmpl, data)
+			return []bundleFile{f}, err
+		},
+	},
+	"macos": {
+		filename: "mig-install-macos.zip",
+		zip:      true,
+		installers: func(data installData) []installerRef {
+			return []installerRef{data.OSX}
+		},
+		scripts: func(data installData) ([]bundleFile, error) {
+			f, err := scriptFile("install.command", osxInstallTmpl, data)
+			return []bundleFile{f}, err
+		},
+	},
+	"windows": {
+		filename: "mig-install-windows.zip",
+		zip:      true,
+		installers: func(data installData) []installerRef {
+			return []installerRef{data.Win}
+		},
+		scripts: func(data installData) ([]bundleFile, error) {
+			f, err := scriptFile("install.ps1", windowsInstallTmpl, data)
+			return []bundleFile{f, {name: "install.cmd", mode: 0755, data: []byte(windowsInstallCmd)}}, err
+		},
+	},
+}
+
+// Return the files to include in a bundle of kind for le
+func (k bundleKind) files(le mig.LoaderEntry) ([]bundleFile, error) {
+	key, err := loaderKeyFile(le)
+	if err != nil {
+		return nil, err
+	}
+	data := newInstallData(le)
+	ret, err := k.scripts(data)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, bundleFile{name: loaderKeyFileName, mode: 0600, data: key})
+	for _, inst := range k.installers(data) {
+		if f, found := cachedInstaller(inst); found {
+			ret = append(ret, f)
+		}
+	}
+	return ret, nil
+}
+
+// Returns true if an installer is available for the bundle, either cached or from a
+// download URL
+func (k bundleKind) available() bool {
+	for _, inst := range k.installers(newInstallData(mig.LoaderEntry{})) {
+		if inst.URL != "" {
+			return true
+		}
+		if _, found := cachedInstaller(inst); found {
+			return true
+		}
+	}
+	return false
+}
+
+func writeTarGz(w io.Writer, files []bundleFile) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+	for _, f := range files {
+		size := f.size
+		if f.path == "" {
+			size = int64(len(f.data))
+		}
+		err := tw.WriteHeader(&tar.Header{
+			Name:    bundleDir + "/" + f.name,
+			Mode:    f.mode,
+			Size:    size,
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		err = copyBundleFile(tw, f)
+		if err != nil {
+			return err
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func writeZip(w io.Writer, files []bundleFile) error {
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		hdr := &zip.FileHeader{Name: bundleDir + "/" + f.name, Method: zip.Deflate}
+		hdr.SetModTime(time.Now())
+		hdr.SetMode(os.FileMode(f.mode))
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		err = copyBundleFile(fw, f)
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func copyBundleFile(w io.Writer, f bundleFile) error {
+	r, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// Serve an installer bundle for the operating system in the request, containing the
+// key for the token in the request
+func handleBundle(rw http.ResponseWriter, req *http.Request) {
+	// Check the bundle can be built before the token is redeemed, so the key is
+	// not lost if it can't be
+	k, ok := bundleKinds[mux.Vars(req)["os"]]
+	if !ok {
+		writeError(rw, req, errNotFound("no installer bundle is available for this operating system", nil))
+		return
+	}
+	if !k.available() {
+		writeError(rw, req, errNotFound("no installer is configured for this operating system", nil))
+		return
+	}
+	le, err := redeemKeyToken(req, mux.Vars(req)["token"])
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+	files, err := k.files(le)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	if k.zip {
+		rw.Header().Set("Content-Type", "application/zip")
+	} else {
+		rw.Header().Set("Content-Type", "application/gzip")
+	}
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%v\"", k.filename))
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	if k.zip {
+		err = writeZip(rw, files)
+	} else {
+		err = writeTarGz(rw, files)
+	}
+	if err != nil {
+		// The response has been started, so the error can only be logged
+		log.Printf("request %v: unable to write bundle for %v: %v", requestID(req), le.Name, err)
+	}
+}
@@ -0,0 +1,164 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mozilla/mig"
+)
+
+// Return a router for the bundle and install script handlers
+func installRouter(t *testing.T) *mux.Router {
+	r := keyRouter(t)
+	r.HandleFunc("/key/{token}/bundle/{os}", setTokenContext(scopeKeys, handleBundle)).Methods("GET")
+	r.HandleFunc("/install/linux.sh", setTokenContext(scopeKeys, handleLinuxInstall)).Methods("GET")
+	return r
+}
+
+// Store a new key for user in the vault, returning the token to retrieve it
+func vaultKey(t *testing.T, user string) (string, mig.LoaderEntry) {
+	le := mig.LoaderEntry{
+		Name:   "migss-" + user + "-1",
+		Prefix: mig.GenerateLoaderPrefix(),
+		Key:    mig.GenerateLoaderKey(),
+	}
+	token, _, err := vault.put(user, le)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, le
+}
+
+// Return the files in a bundle, indexed by name
+func readBundle(t *testing.T, buf []byte, isZip bool) map[string][]byte {
+	ret := make(map[string][]byte)
+	if isZip {
+		zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ret[f.Name], err = ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return ret
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == bundleDir+"/"+loaderKeyFileName && hdr.Mode != 0600 {
+			t.Errorf("key file mode is %o", hdr.Mode)
+		}
+		ret[hdr.Name], err = ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ret
+}
+
+func TestBundle(t *testing.T) {
+	useMemoryBackend(t)
+	r := installRouter(t)
+	useDownloads(t, "https://example.com/mig-agent.rpm", "https://example.com/mig-agent.deb",
+		"https://example.com/mig-agent.pkg", "https://example.com/mig-agent.msi")
+	cache, err := ioutil.TempDir("", "migss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	err = ioutil.WriteFile(filepath.Join(cache, "mig-agent.deb"), []byte("deb package"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCache := cfg.InstallerCache
+	cfg.InstallerCache = cache
+	defer func() { cfg.InstallerCache = oldCache }()
+	user := "user@example.com"
+
+	for _, tt := range []struct {
+		os    string
+		zip   bool
+		files []string
+	}{
+		{"linux", false, []string{"install.sh", loaderKeyFileName, "mig-agent.deb"}},
+		{"macos", true, []string{"install.command", loaderKeyFileName}},
+		{"windows", true, []string{"install.ps1", "install.cmd", loaderKeyFileName}},
+	} {
+		token, le := vaultKey(t, user)
+		rw := serveAs(t, r, user, "GET", "/key/"+token+"/bundle/"+tt.os, "")
+		if rw.Code != 200 {
+			t.Fatalf("%v: got %v %v", tt.os, rw.Code, rw.Body.String())
+		}
+		cd := rw.Header().Get("Content-Disposition")
+		if cd != `attachment; filename="`+bundleKinds[tt.os].filename+`"` {
+			t.Errorf("%v: Content-Disposition %q", tt.os, cd)
+		}
+		files := readBundle(t, rw.Body.Bytes(), tt.zip)
+		if len(files) != len(tt.files) {
+			t.Errorf("%v: bundle holds %v files, want %v", tt.os, len(files), tt.files)
+		}
+		for _, name := range tt.files {
+			if _, ok := files[bundleDir+"/"+name]; !ok {
+				t.Errorf("%v: bundle does not hold %v", tt.os, name)
+			}
+		}
+		if k := string(files[bundleDir+"/"+loaderKeyFileName]); k != le.Prefix+le.Key {
+			t.Errorf("%v: key file holds %q", tt.os, k)
+		}
+		if tt.os == "linux" && string(files[bundleDir+"/mig-agent.deb"]) != "deb package" {
+			t.Errorf("linux: cached package not included")
+		}
+		// The token can't be used again
+		rw = serveAs(t, r, user, "GET", "/key/"+token+"/bundle/"+tt.os, "")
+		if rw.Code != 404 {
+			t.Errorf("%v: repeated request got %v", tt.os, rw.Code)
+		}
+	}
+
+	// A bundle for an unknown operating system, or one without an installer, is
+	// rejected without redeeming the token
+	token, _ := vaultKey(t, user)
+	rw := serveAs(t, r, user, "GET", "/key/"+token+"/bundle/plan9", "")
+	if rw.Code != 404 || errorCode(t, rw) != errCodeNotFound {
+		t.Fatalf("unknown os: got %v %v", rw.Code, rw.Body.String())
+	}
+	cfg.DownloadOSX = ""
+	rw = serveAs(t, r, user, "GET", "/key/"+token+"/bundle/macos", "")
+	if rw.Code != 404 || errorCode(t, rw) != errCodeNotFound {
+		t.Fatalf("os without an installer: got %v %v", rw.Code, rw.Body.String())
+	}
+	rw = serveAs(t, r, user, "GET", "/key/"+token+"/bundle/windows", "")
+	if rw.Code != 200 {
+		t.Fatalf("token redeemed by a rejected request: got %v %v", rw.Code, rw.Body.String())
+	}
+}
@@ -0,0 +1,181 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Largest response read from the portal
+const maxResponse = 1024 * 1024
+
+// Attempts made to issue a key, and the delay between them
+const issueAttempts = 3
+
+var issueRetryDelay = time.Second
+
+// An agent enrolled using the key for a slot
+type agent struct {
+	Hostname  string    `json:"hostname"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	Version   string    `json:"version"`
+	HeartBeat time.Time `json:"heartbeat"`
+	Status    string    `json:"status"`
+}
+
+type slot struct {
+	Slot     int        `json:"slot"`
+	Status   string     `json:"status"`
+	Loader   string     `json:"loader"`
+	LastUsed *time.Time `json:"last_used"`
+	Agent    *agent     `json:"agent"`
+}
+
+type slotList struct {
+	Slots []slot `json:"slots"`
+}
+
+type keyRequest struct {
+	Replace bool `json:"replace,omitempty"`
+}
+
+type keyIssued struct {
+	Slot        int       `json:"slot"`
+	Loader      string    `json:"loader"`
+	Token       string    `json:"token"`
+	Expires     time.Time `json:"expires"`
+	KeyURL      string    `json:"key_url"`
+	DownloadURL string    `json:"download_url"`
+}
+
+// An error returned by the portal
+type portalError struct {
+	Status    int
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+func (p *portalError) Error() string {
+	if p.RequestID != "" {
+		return fmt.Sprintf("%v (%v, request %v)", p.Message, p.Status, p.RequestID)
+	}
+	return fmt.Sprintf("%v (%v)", p.Message, p.Status)
+}
+
+// A client for the portal API
+type client struct {
+	base  *url.URL
+	token string
+	hc    *http.Client
+}
+
+func newClient(base string, token string) (*client, error) {
+	u, err := url.Parse(strings.TrimSuffix(base, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Hostname() != "localhost" && u.Hostname() != "127.0.0.1" {
+		return nil, fmt.Errorf("portal URL must use https")
+	}
+	return &client{base: u, token: token, hc: &http.Client{Timeout: 2 * time.Minute}}, nil
+}
+
+// Make a request for path, relative to the portal URL. If body is not nil it is sent
+// as JSON, and if ret is not nil the response is decoded into it. The raw response
+// body is returned.
+func (c *client) do(method string, path string, body interface{}, ret interface{}, hdr ...string) ([]byte, error) {
+	u, err := c.base.Parse(strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return nil, err
+	}
+	var rd io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		rd = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, u.String(), rd)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(hdr); i += 2 {
+		req.Header.Set(hdr[i], hdr[i+1])
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		pe := &portalError{Status: resp.StatusCode}
+		if json.Unmarshal(buf, pe) != nil || pe.Message == "" {
+			pe.Message = http.StatusText(resp.StatusCode)
+		}
+		return nil, pe
+	}
+	if ret != nil {
+		err = json.Unmarshal(buf, ret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid response from portal: %v", err)
+		}
+	}
+	return buf, nil
+}
+
+func (c *client) slots() (ret slotList, err error) {
+	_, err = c.do("GET", "api/v1/slots", nil, &ret)
+	return
+}
+
+// Issue a key for slot n. The request carries an idempotency key, so if it fails
+// before a response is received it can safely be repeated.
+func (c *client) issueKey(n int, replace bool) (ret keyIssued, err error) {
+	buf := make([]byte, 16)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return
+	}
+	idem := hex.EncodeToString(buf)
+	path := fmt.Sprintf("api/v1/slots/%d/key", n)
+	for i := 0; i < issueAttempts; i++ {
+		if i > 0 {
+			time.Sleep(issueRetryDelay)
+		}
+		_, err = c.do("POST", path, &keyRequest{Replace: replace}, &ret, "Idempotency-Key", idem)
+		if _, ok := err.(*portalError); ok || err == nil {
+			return
+		}
+	}
+	return
+}
+
+// Retrieve the key file for an issued key
+func (c *client) keyFile(k keyIssued) ([]byte, error) {
+	return c.do("GET", k.DownloadURL, nil, nil)
+}
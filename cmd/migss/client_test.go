@@ -0,0 +1,206 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozilla/mig"
+)
+
+// A fake portal serving the parts of the API used by the client. If dropFirst is
+// set the connection for the first key request is closed after the key is issued,
+// as if the response was lost.
+type fakePortal struct {
+	srv       *httptest.Server
+	key       string
+	dropFirst bool
+
+	sync.Mutex
+	issued  map[string]keyIssued // Issued keys by idempotency key
+	idem    []string             // Idempotency key of each key request
+	replace []bool               // Replace flag of each key request
+}
+
+func newFakePortal(t *testing.T) *fakePortal {
+	f := &fakePortal{
+		key:    mig.GenerateLoaderPrefix() + mig.GenerateLoaderKey(),
+		issued: make(map[string]keyIssued),
+	}
+	mx := http.NewServeMux()
+	mx.HandleFunc("/api/v1/slots", func(rw http.ResponseWriter, req *http.Request) {
+		lastused := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		json.NewEncoder(rw).Encode(slotList{Slots: []slot{
+			{Slot: 1, Status: "active", Loader: "migss-user@example.com-1", LastUsed: &lastused,
+				Agent: &agent{Hostname: "host1", OS: "linux", Arch: "amd64"}},
+			{Slot: 2, Status: "unassigned"},
+		}})
+	})
+	mx.HandleFunc("/api/v1/slots/1/key", func(rw http.ResponseWriter, req *http.Request) {
+		var kr keyRequest
+		if req.Method != "POST" || json.NewDecoder(req.Body).Decode(&kr) != nil {
+			http.Error(rw, "bad request", http.StatusBadRequest)
+			return
+		}
+		idem := req.Header.Get("Idempotency-Key")
+		f.Lock()
+		f.idem = append(f.idem, idem)
+		f.replace = append(f.replace, kr.Replace)
+		ki, ok := f.issued[idem]
+		if !ok {
+			ki = keyIssued{Slot: 1, Loader: "migss-user@example.com-1", Token: "tok1",
+				KeyURL: "/key/tok1", DownloadURL: "/key/tok1/download"}
+			f.issued[idem] = ki
+		}
+		drop := f.dropFirst && len(f.idem) == 1
+		f.Unlock()
+		if drop {
+			conn, _, err := rw.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		json.NewEncoder(rw).Encode(&ki)
+	})
+	mx.HandleFunc("/api/v1/slots/2/key", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusConflict)
+		rw.Write([]byte(`{"code":"conflict","message":"a key is already assigned to this slot","request_id":"r1"}`))
+	})
+	mx.HandleFunc("/key/tok1/download", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(f.key))
+	})
+	f.srv = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token1" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mx.ServeHTTP(rw, req)
+	}))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakePortal) client(t *testing.T, token string) *client {
+	cli, err := newClient(f.srv.URL, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+func TestNewClient(t *testing.T) {
+	if _, err := newClient("http://portal.example.com", "t"); err == nil {
+		t.Fatal("client created for a portal URL without https")
+	}
+	cli, err := newClient("https://portal.example.com/migss", "t")
+	if err != nil || cli.base.String() != "https://portal.example.com/migss/" {
+		t.Fatalf("newClient: got %v, %v", cli, err)
+	}
+}
+
+func TestSlots(t *testing.T) {
+	f := newFakePortal(t)
+	sl, err := f.client(t, "token1").slots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sl.Slots) != 2 || sl.Slots[0].Agent == nil || sl.Slots[0].Agent.Hostname != "host1" ||
+		sl.Slots[1].Status != "unassigned" {
+		t.Fatalf("slots: got %+v", sl)
+	}
+
+	_, err = f.client(t, "wrong").slots()
+	pe, ok := err.(*portalError)
+	if !ok || pe.Status != http.StatusUnauthorized || pe.Message != "Unauthorized" {
+		t.Fatalf("slots with an invalid token: got %v", err)
+	}
+}
+
+// A key request that fails before a response is received is repeated with the same
+// idempotency key, so the portal issues the key once
+func TestIssueKeyRetry(t *testing.T) {
+	issueRetryDelay = time.Millisecond
+	f := newFakePortal(t)
+	f.dropFirst = true
+	ki, err := f.client(t, "token1").issueKey(1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ki.Token != "tok1" || ki.DownloadURL != "/key/tok1/download" {
+		t.Fatalf("issueKey: got %+v", ki)
+	}
+	f.Lock()
+	defer f.Unlock()
+	if len(f.idem) != 2 || f.idem[0] == "" || f.idem[0] != f.idem[1] || len(f.issued) != 1 {
+		t.Fatalf("key requests made with idempotency keys %q", f.idem)
+	}
+	if !f.replace[0] || !f.replace[1] {
+		t.Fatal("replace was not requested")
+	}
+}
+
+// Errors returned by the portal are reported, and not retried
+func TestIssueKeyError(t *testing.T) {
+	f := newFakePortal(t)
+	_, err := f.client(t, "token1").issueKey(2, false)
+	pe, ok := err.(*portalError)
+	if !ok || pe.Status != http.StatusConflict || pe.Code != "conflict" || pe.RequestID != "r1" {
+		t.Fatalf("issueKey: got %#v", err)
+	}
+	if pe.Error() != "a key is already assigned to this slot (409, request r1)" {
+		t.Fatalf("unexpected error message %q", pe.Error())
+	}
+}
+
+func TestClaim(t *testing.T) {
+	f := newFakePortal(t)
+	keyfile := filepath.Join(t.TempDir(), "etc", "mig", "mig-loader.key")
+	err := runClaim(f.client(t, "token1"), []string{"-keyfile", keyfile, "slot1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(keyfile)
+	if err != nil || string(buf) != f.key {
+		t.Fatalf("key file holds %q, %v", buf, err)
+	}
+	fi, err := os.Stat(keyfile)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("key file mode %v, %v", fi.Mode(), err)
+	}
+	if err = runClaim(f.client(t, "token1"), []string{"-keyfile", keyfile, "x"}); err == nil {
+		t.Fatal("claim accepted an invalid slot")
+	}
+}
+
+func TestWriteKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mig-loader.key")
+	for _, key := range []string{"first", "second"} {
+		if err := writeKeyFile(path, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil || string(buf) != key {
+			t.Fatalf("key file holds %q, %v", buf, err)
+		}
+	}
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil || len(ents) != 1 {
+		t.Fatalf("temporary files left in %v: %v", dir, ents)
+	}
+}
@@ -0,0 +1,205 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+
+// migss is a command line client for the MIG self-service portal, for enrolling
+// systems without a browser. It authenticates using a personal access token
+// created in the portal, read from the MIGSS_TOKEN environment variable or a file.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mozilla/mig"
+)
+
+const defaultKeyFile = "/etc/mig/mig-loader.key"
+
+const defaultLoader = "/sbin/mig-loader"
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: migss [options] command [arguments]
+
+commands:
+  slots                 list your key slots
+  claim [options] slot  issue a key for a slot and install it
+
+options:
+`)
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+The portal URL can also be set with MIGSS_URL, and the token with MIGSS_TOKEN.
+Run "migss claim -h" for the options accepted by claim.
+`)
+}
+
+// Return the access token, from tokenfile if set and otherwise from the environment
+func readToken(tokenfile string) (string, error) {
+	if tokenfile != "" {
+		buf, err := ioutil.ReadFile(tokenfile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(buf)), nil
+	}
+	if v := os.Getenv("MIGSS_TOKEN"); v != "" {
+		return v, nil
+	}
+	return "", fmt.Errorf("no access token, set MIGSS_TOKEN or use -tokenfile")
+}
+
+func runSlots(cli *client, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("slots takes no arguments")
+	}
+	sl, err := cli.slots()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SLOT\tSTATUS\tLAST USED\tDEVICE")
+	for _, s := range sl.Slots {
+		lastused, device := "-", "-"
+		if s.LastUsed != nil {
+			lastused = s.LastUsed.Local().Format(time.RFC3339)
+		}
+		if s.Agent != nil {
+			device = fmt.Sprintf("%v (%v/%v)", s.Agent.Hostname, s.Agent.OS, s.Agent.Arch)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", s.Slot, s.Status, lastused, device)
+	}
+	return tw.Flush()
+}
+
+// Write the key to path, replacing any existing file. The key is written to a
+// temporary file which is renamed into place, so a partially written key is never
+// left in place of a working one.
+func writeKeyFile(path string, key []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	fd, err := ioutil.TempFile(filepath.Dir(path), ".mig-loader.key")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+	err = fd.Chmod(0600)
+	if err == nil {
+		_, err = fd.Write(key)
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(fd.Name(), path)
+}
+
+func runClaim(cli *client, args []string) error {
+	var (
+		replace bool
+		run     bool
+		keyfile string
+		loader  string
+	)
+
+	fs := flag.NewFlagSet("claim", flag.ExitOnError)
+	fs.BoolVar(&replace, "replace", false, "replace the key if the slot already has an active key")
+	fs.BoolVar(&run, "run", false, "run the loader once the key has been installed")
+	fs.StringVar(&keyfile, "keyfile", defaultKeyFile, "path the key is written to")
+	fs.StringVar(&loader, "loader", defaultLoader, "path to mig-loader, used with -run")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("claim requires a slot number")
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(fs.Arg(0), "slot"))
+	if err != nil {
+		return fmt.Errorf("invalid slot %q", fs.Arg(0))
+	}
+
+	ki, err := cli.issueKey(n, replace)
+	if err != nil {
+		return err
+	}
+	key, err := cli.keyFile(ki)
+	if err != nil {
+		return fmt.Errorf("key for slot %v was issued but could not be retrieved: %v", n, err)
+	}
+	err = mig.ValidateLoaderPrefixAndKey(string(key))
+	if err != nil {
+		return fmt.Errorf("portal returned an invalid key: %v", err)
+	}
+	err = writeKeyFile(keyfile, key)
+	if err != nil {
+		return fmt.Errorf("unable to write key file: %v", err)
+	}
+	fmt.Printf("key for slot %v (%v) written to %v\n", n, ki.Loader, keyfile)
+	if !run {
+		return nil
+	}
+	cmd := exec.Command(loader)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func main() {
+	var (
+		portal    string
+		tokenfile string
+	)
+
+	flag.Usage = usage
+	flag.StringVar(&portal, "url", os.Getenv("MIGSS_URL"), "URL of the self-service portal")
+	flag.StringVar(&tokenfile, "tokenfile", "", "file containing the personal access token")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	if portal == "" {
+		fmt.Fprintf(os.Stderr, "error: no portal URL, set MIGSS_URL or use -url\n")
+		os.Exit(1)
+	}
+	token, err := readToken(tokenfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	cli, err := newClient(portal, token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	args := flag.Args()
+	switch args[0] {
+	case "slots":
+		err = runSlots(cli, args[1:])
+	case "claim":
+		err = runClaim(cli, args[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,142 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+const (
+	csrfCookie = "migss-csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+var csrfKey []byte
+
+// Initialize the key used to generate CSRF tokens
+func csrfInit() error {
+	if cfg.CSRFKey != "" {
+		csrfKey = []byte(cfg.CSRFKey)
+		return nil
+	}
+	// Tokens will be invalidated on restart and will not be accepted by other
+	// instances of the portal
+	log.Printf("csrfkey not set, using a random CSRF key")
+	k, err := randomString(32)
+	if err != nil {
+		return err
+	}
+	csrfKey = []byte(k)
+	return nil
+}
+
+// Compute the CSRF token for a session identifier and user
+func csrfCompute(sessid string, user string) string {
+	m := hmac.New(sha256.New, csrfKey)
+	m.Write([]byte(sessid + "|" + user))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// Return a CSRF token for the user, setting the CSRF session cookie in the
+// response if the request does not already have one
+func csrfToken(rw http.ResponseWriter, req *http.Request, user string) (string, error) {
+	c, err := req.Cookie(csrfCookie)
+	if err == nil && c.Value != "" {
+		return csrfCompute(c.Value, user), nil
+	}
+	sessid, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    sessid,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   cfg.SecureCookies || req.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return csrfCompute(sessid, user), nil
+}
+
+// Verify the Origin header of the request, or the Referer header if no Origin is
+// present, refers to the portal or one of the configured allowed origins
+func csrfCheckOrigin(req *http.Request) error {
+	src := req.Header.Get("Origin")
+	if src == "" {
+		src = req.Header.Get("Referer")
+	}
+	if src == "" {
+		return fmt.Errorf("request has no origin")
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return fmt.Errorf("invalid request origin")
+	}
+	if u.Host == req.Host {
+		return nil
+	}
+	for _, x := range cfg.AllowedOrigins {
+		o, err := url.Parse(x)
+		if err != nil {
+			continue
+		}
+		if o.Scheme == u.Scheme && o.Host == u.Host {
+			return nil
+		}
+	}
+	return fmt.Errorf("request origin %v not permitted", u.Host)
+}
+
+// Verify the CSRF token in the request
+func csrfCheckToken(req *http.Request, user string) error {
+	c, err := req.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return fmt.Errorf("no CSRF session")
+	}
+	tok := req.Header.Get(csrfHeader)
+	if tok == "" {
+		return fmt.Errorf("no CSRF token in request")
+	}
+	if !hmac.Equal([]byte(tok), []byte(csrfCompute(c.Value, user))) {
+		return fmt.Errorf("invalid CSRF token")
+	}
+	return nil
+}
+
+// Wraps handlers for state changing requests, rejecting requests that do not
+// originate from the portal or do not include a valid CSRF token. Requests made
+// using a personal access token are exempt, since a browser never adds the token
+// to a request itself.
+func csrfProtect(h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if isTokenRequest(req) {
+			h(rw, req)
+			return
+		}
+		rdetails, err := newRequestDetails(req)
+		if err != nil {
+			writeError(rw, req, errUnauthorized("no valid identity for request", err))
+			return
+		}
+		err = csrfCheckOrigin(req)
+		if err == nil {
+			err = csrfCheckToken(req, rdetails.remoteUser)
+		}
+		if err != nil {
+			auditor.failure(newAuditEvent(req, rdetails.remoteUser, auditCSRFFailure), err)
+			writeError(rw, req, errForbidden("the request could not be verified, reload the page and try again", err))
+			return
+		}
+		h(rw, req)
+	}
+}
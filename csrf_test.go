@@ -0,0 +1,100 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Use a fixed CSRF key for the duration of the test
+func useCSRFKey(t *testing.T) {
+	old := csrfKey
+	csrfKey = []byte("csrf-key")
+	t.Cleanup(func() { csrfKey = old })
+}
+
+func TestCSRFCheckOrigin(t *testing.T) {
+	old := cfg.AllowedOrigins
+	cfg.AllowedOrigins = []string{"https://console.example.net"}
+	t.Cleanup(func() { cfg.AllowedOrigins = old })
+	tests := []struct {
+		origin  string
+		referer string
+		ok      bool
+	}{
+		{"https://portal.example.com", "", true},
+		{"", "https://portal.example.com/page", true},
+		{"https://console.example.net", "", true},
+		{"", "", false},
+		{"https://evil.example.com", "", false},
+		// Origin takes precedence over Referer
+		{"https://evil.example.com", "https://portal.example.com/", false},
+		{"http://console.example.net", "", false},
+		{"https://portal.example.com.evil.example.com", "", false},
+		{"null", "", false},
+		{"%zz", "", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "https://portal.example.com/newkey", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.referer != "" {
+			req.Header.Set("Referer", tt.referer)
+		}
+		if err := csrfCheckOrigin(req); (err == nil) != tt.ok {
+			t.Errorf("origin %q, referer %q: got %v", tt.origin, tt.referer, err)
+		}
+	}
+}
+
+func TestCSRFProtect(t *testing.T) {
+	useCSRFKey(t)
+	user := "user@example.com"
+	r := mux.NewRouter()
+	r.HandleFunc("/newkey", setContext(csrfProtect(func(http.ResponseWriter, *http.Request) {}))).Methods("POST")
+
+	// A token is issued with a new session cookie, or for the existing session
+	rw := httptest.NewRecorder()
+	tok, err := csrfToken(rw, httptest.NewRequest("GET", "/", nil), user)
+	sess := responseCookie(rw, csrfCookie)
+	if err != nil || sess == "" || tok != csrfCompute(sess, user) {
+		t.Fatalf("csrfToken: got %q, session %q, %v", tok, sess, err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: sess})
+	rw = httptest.NewRecorder()
+	if again, _ := csrfToken(rw, req, user); again != tok || responseCookie(rw, csrfCookie) != "" {
+		t.Fatalf("csrfToken with a session: got %q", again)
+	}
+
+	cookie := csrfCookie + "=" + sess
+	tests := []struct {
+		name string
+		hdr  []string
+		code int
+	}{
+		{"valid", []string{"Origin", "http://example.com", "Cookie", cookie, csrfHeader, tok}, 200},
+		{"no origin", []string{"Cookie", cookie, csrfHeader, tok}, 403},
+		{"other origin", []string{"Origin", "http://evil.example.com", "Cookie", cookie, csrfHeader, tok}, 403},
+		{"no session", []string{"Origin", "http://example.com", csrfHeader, tok}, 403},
+		{"no token", []string{"Origin", "http://example.com", "Cookie", cookie}, 403},
+		{"token for another session", []string{"Origin", "http://example.com",
+			"Cookie", csrfCookie + "=other", csrfHeader, tok}, 403},
+		{"token for another user", []string{"Origin", "http://example.com", "Cookie", cookie,
+			csrfHeader, csrfCompute(sess, "other@example.com")}, 403},
+	}
+	for _, tt := range tests {
+		rw := serveAs(t, r, user, "POST", "/newkey", "", tt.hdr...)
+		if rw.Code != tt.code {
+			t.Errorf("%v: got %v %v", tt.name, rw.Code, rw.Body.String())
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+// Error codes returned in the code field of error responses
+const (
+	errCodeBadRequest      = "bad_request"
+	errCodeUnauthorized    = "unauthorized"
+	errCodeForbidden       = "forbidden"
+	errCodeNotFound        = "not_found"
+	errCodeConflict        = "conflict"
+	errCodeRateLimited     = "rate_limited"
+	errCodeNotAcceptable   = "not_acceptable"
+	errCodeUnsupportedType = "unsupported_media_type"
+	errCodeUpstream        = "upstream_error"
+	errCodeUnavailable     = "unavailable"
+	errCodeInternal        = "internal_error"
+)
+
+// An error reported to the client. The message is shown to the user; the cause
+// holds any internal details, which are logged but never returned in a response.
+type portalError struct {
+	status  int
+	code    string
+	message string
+	cause   error
+
+	retryAfter time.Duration // If set, returned in a Retry-After header
+}
+
+func (p *portalError) Error() string {
+	if p.cause != nil {
+		return fmt.Sprintf("%v: %v", p.message, p.cause)
+	}
+	return p.message
+}
+
+func errBadRequest(msg string, cause error) error {
+	return &portalError{status: http.StatusBadRequest, code: errCodeBadRequest, message: msg, cause: cause}
+}
+
+func errUnauthorized(msg string, cause error) error {
+	return &portalError{status: http.StatusUnauthorized, code: errCodeUnauthorized, message: msg, cause: cause}
+}
+
+func errForbidden(msg string, cause error) error {
+	return &portalError{status: http.StatusForbidden, code: errCodeForbidden, message: msg, cause: cause}
+}
+
+func errNotFound(msg string, cause error) error {
+	return &portalError{status: http.StatusNotFound, code: errCodeNotFound, message: msg, cause: cause}
+}
+
+func errConflict(msg string, cause error) error {
+	return &portalError{status: http.StatusConflict, code: errCodeConflict, message: msg, cause: cause}
+}
+
+func errNotAcceptable(msg string) error {
+	return &portalError{status: http.StatusNotAcceptable, code: errCodeNotAcceptable, message: msg}
+}
+
+func errUnsupportedType(msg string) error {
+	return &portalError{status: http.StatusUnsupportedMediaType, code: errCodeUnsupportedType, message: msg}
+}
+
+func errRateLimited(msg string, retryAfter time.Duration, cause error) error {
+	return &portalError{status: http.StatusTooManyRequests, code: errCodeRateLimited, message: msg,
+		cause: cause, retryAfter: retryAfter}
+}
+
+func errUnavailable(msg string, cause error) error {
+	return &portalError{status: http.StatusServiceUnavailable, code: errCodeUnavailable, message: msg, cause: cause}
+}
+
+func errInternal(cause error) error {
+	return &portalError{status: http.StatusInternalServerError, code: errCodeInternal,
+		message: "an internal error occurred", cause: cause}
+}
+
+// Returns true if err indicates the MIG API could not be reached or is not able to
+// handle requests
+func isUnavailable(err error) bool {
+	if err == errBreakerOpen {
+		return true
+	}
+	s := err.Error()
+	return strings.Contains(s, "failed to contact the API") ||
+		strings.Contains(s, "HTTP 502") ||
+		strings.Contains(s, "HTTP 503") ||
+		strings.Contains(s, "HTTP 504")
+}
+
+// Convert an error returned by the MIG backend into an error for the client
+func errMIG(cause error) error {
+	if _, ok := cause.(*portalError); ok {
+		return cause
+	}
+	switch {
+	case isNotFound(cause):
+		return errNotFound("the loader entry was not found", cause)
+	case isUnavailable(cause):
+		return errUnavailable("MIG is currently unavailable, please try again later", cause)
+	}
+	return &portalError{status: http.StatusBadGateway, code: errCodeUpstream,
+		message: "the request to MIG failed", cause: cause}
+}
+
+type requestIDType int
+
+const requestIDKey requestIDType = 0
+
+// Return the ID assigned to the request, assigning one if it does not have one
+func requestID(req *http.Request) string {
+	if v, ok := context.Get(req, requestIDKey).(string); ok {
+		return v
+	}
+	id, err := randomString(12)
+	if err != nil {
+		id = "unknown"
+	}
+	context.Set(req, requestIDKey, id)
+	return id
+}
+
+// Assign an ID to each request, which is returned in the X-Request-ID header and
+// included in error responses and logs so errors reported by users can be located
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Request-ID", requestID(req))
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// The body of an error response
+type errorReply struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+// Log err and write an error response for it. Errors that are not a portalError
+// are treated as internal errors.
+func writeError(rw http.ResponseWriter, req *http.Request, err error) {
+	pe, ok := err.(*portalError)
+	if !ok {
+		pe = errInternal(err).(*portalError)
+	}
+	id := requestID(req)
+	log.Printf("request %v: %v %v: %v %v", id, req.Method, routePath(req), pe.status, pe)
+	buf, err := json.Marshal(&errorReply{Code: pe.code, Message: pe.message, RequestID: id})
+	if err != nil {
+		http.Error(rw, pe.message, pe.status)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	if pe.retryAfter > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(pe.retryAfter)))
+	}
+	rw.WriteHeader(pe.status)
+	fmt.Fprint(rw, string(buf))
+}
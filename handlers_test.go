@@ -0,0 +1,199 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mozilla/mig"
+	"github.com/mozilla/mig-selfservice/migmem"
+)
+
+// Use the MIG API client for the duration of the test, with requests made to an
+// API served from a new in-memory backend
+func useAPIServer(t *testing.T) *migmem.Backend {
+	b := migmem.New()
+	srv := httptest.NewServer(migmem.NewServer(b, "apikey"))
+	oldBackend, oldURL, oldKey, oldClient := cfg.Backend, cfg.APIUrl, cfg.APIKey, cfg.APIClient
+	cfg.Backend = "api"
+	cfg.APIUrl = srv.URL + "/api/v1/"
+	cfg.APIKey = "apikey"
+	cfg.APIClient = apiClientConfig{RetryDelay: time.Millisecond, BreakerThreshold: 1000}
+	resetAPI := func() {
+		sharedAPILock.Lock()
+		sharedAPI = nil
+		sharedAPILock.Unlock()
+	}
+	resetAPI()
+	t.Cleanup(func() {
+		srv.Close()
+		cfg.Backend, cfg.APIUrl, cfg.APIKey, cfg.APIClient = oldBackend, oldURL, oldKey, oldClient
+		resetAPI()
+	})
+	return b
+}
+
+// Return a router for the key handlers, without the CSRF checks and rate limits
+// applied to them in the portal
+func keyRouter(t *testing.T) *mux.Router {
+	useMemoryStore(t)
+	if err := vaultInit(); err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/keystatus", setTokenContext(scopeStatus, handleKeyStatus)).Methods("GET")
+	r.HandleFunc("/newkey", setTokenContext(scopeKeys, trackKeyOp(serializeKeyOp(handleNewKey)))).Methods("POST")
+	r.HandleFunc("/key/{token}", setTokenContext(scopeKeys, handleGetKey)).Methods("GET")
+	r.HandleFunc("/delkey", setTokenContext(scopeKeys, trackKeyOp(serializeKeyOp(handleDelKey)))).Methods("POST")
+	return r
+}
+
+// Decode the error code from an error response
+func errorCode(t *testing.T, rw *httptest.ResponseRecorder) string {
+	var er errorReply
+	if err := json.Unmarshal(rw.Body.Bytes(), &er); err != nil {
+		t.Fatalf("invalid error response %q: %v", rw.Body.String(), err)
+	}
+	return er.Code
+}
+
+// Issue a key for slot, returning the key retrieved using the token in the response
+func newKey(t *testing.T, r *mux.Router, user string, slot string) string {
+	rw := serveAs(t, r, user, "POST", "/newkey", `{"slot":"`+slot+`"}`)
+	var reply newkeyReply
+	if rw.Code != 200 || json.Unmarshal(rw.Body.Bytes(), &reply) != nil {
+		t.Fatalf("newkey %v: got %v %v", slot, rw.Code, rw.Body.String())
+	}
+	rw = serveAs(t, r, user, "GET", "/key/"+reply.Token, "")
+	var kr keyReply
+	if rw.Code != 200 || json.Unmarshal(rw.Body.Bytes(), &kr) != nil {
+		t.Fatalf("key for %v: got %v %v", slot, rw.Code, rw.Body.String())
+	}
+	return kr.Key
+}
+
+func keyStatus(t *testing.T, r *mux.Router, user string) (ret loadersReply) {
+	rw := serveAs(t, r, user, "GET", "/keystatus", "")
+	if rw.Code != 200 || json.Unmarshal(rw.Body.Bytes(), &ret) != nil {
+		t.Fatalf("keystatus: got %v %v", rw.Code, rw.Body.String())
+	}
+	return
+}
+
+func TestKeyHandlers(t *testing.T) {
+	b := useAPIServer(t)
+	r := keyRouter(t)
+	user := "user@example.com"
+
+	if st := keyStatus(t, r, user); len(st.Loaders) != 0 || len(st.Agents) != 0 {
+		t.Fatalf("keystatus with no keys: got %+v", st)
+	}
+
+	// Create a key, and enroll an agent using it
+	key1 := newKey(t, r, user, "slot1")
+	if err := mig.ValidateLoaderPrefixAndKey(key1); err != nil {
+		t.Fatalf("invalid key %q: %v", key1, err)
+	}
+	ldrs := b.Loaders()
+	if len(ldrs) != 1 || ldrs[0].Name != "migss-user@example.com-1" || !ldrs[0].Enabled {
+		t.Fatalf("loaders after create: %+v", ldrs)
+	}
+	err := b.Enroll("migss-user@example.com-1", mig.Agent{Name: "host1.example.com", Env: mig.AgentEnv{OS: "linux"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := keyStatus(t, r, user)
+	if len(st.Loaders) != 1 || len(st.Agents) != 1 || st.Agents[0].Slot != 1 ||
+		st.Agents[0].Hostname != "host1.example.com" {
+		t.Fatalf("keystatus after enrollment: got %+v", st)
+	}
+	// Other users do not see the entry
+	if st := keyStatus(t, r, "other@example.com"); len(st.Loaders) != 0 {
+		t.Fatalf("keystatus for another user: got %+v", st)
+	}
+
+	// Rekeying replaces the key on the existing entry
+	key2 := newKey(t, r, user, "slot1")
+	if key2 == key1 {
+		t.Fatal("rekey returned the previous key")
+	}
+	if ldrs = b.Loaders(); len(ldrs) != 1 || !ldrs[0].Enabled {
+		t.Fatalf("loaders after rekey: %+v", ldrs)
+	}
+
+	// Disable the entry; a slot without an entry can't be disabled
+	rw := serveAs(t, r, user, "POST", "/delkey", `{"slot":"slot1"}`)
+	if rw.Code != 200 {
+		t.Fatalf("delkey: got %v %v", rw.Code, rw.Body.String())
+	}
+	if ldrs = b.Loaders(); ldrs[0].Enabled {
+		t.Fatal("loader enabled after delkey")
+	}
+	rw = serveAs(t, r, user, "POST", "/delkey", `{"slot":"slot2"}`)
+	if rw.Code != 404 || errorCode(t, rw) != errCodeNotFound {
+		t.Fatalf("delkey for empty slot: got %v %v", rw.Code, rw.Body.String())
+	}
+	rw = serveAs(t, r, user, "POST", "/newkey", `{"slot":"slot99"}`)
+	if rw.Code != 400 {
+		t.Fatalf("newkey for invalid slot: got %v %v", rw.Code, rw.Body.String())
+	}
+}
+
+// Errors returned by the MIG API are reported to the client, and leave the user's
+// entries unchanged or disabled; a failed rekey disables the entry since the key
+// may have been changed
+func TestKeyHandlersMIGErrors(t *testing.T) {
+	b := useAPIServer(t)
+	r := keyRouter(t)
+	user := "user@example.com"
+	newKey(t, r, user, "slot1")
+	failOp := func(op string, status int) {
+		b.Fail = func(o string) error {
+			if o == op {
+				return &migmem.Error{Status: status, Message: "injected failure"}
+			}
+			return nil
+		}
+	}
+
+	tests := []struct {
+		op     string
+		status int
+		method string
+		path   string
+		body   string
+		code   int
+		errc   string
+	}{
+		{"Search", 503, "GET", "/keystatus", "", 503, errCodeUnavailable},
+		{"Search", 500, "GET", "/keystatus", "", 502, errCodeUpstream},
+		{"Search", 503, "POST", "/newkey", `{"slot":"slot1"}`, 503, errCodeUnavailable},
+		{"PostNewLoader", 500, "POST", "/newkey", `{"slot":"slot2"}`, 502, errCodeUpstream},
+		{"PostNewLoader", 503, "POST", "/newkey", `{"slot":"slot2"}`, 503, errCodeUnavailable},
+		{"LoaderEntryStatus", 500, "POST", "/delkey", `{"slot":"slot1"}`, 502, errCodeUpstream},
+		{"LoaderEntryKey", 500, "POST", "/newkey", `{"slot":"slot1"}`, 502, errCodeUpstream},
+		{"LoaderEntryKey", 503, "POST", "/newkey", `{"slot":"slot1"}`, 503, errCodeUnavailable},
+	}
+	for _, tt := range tests {
+		failOp(tt.op, tt.status)
+		rw := serveAs(t, r, user, tt.method, tt.path, tt.body)
+		if rw.Code != tt.code || errorCode(t, rw) != tt.errc {
+			t.Errorf("%v %v with %v failing with %v: got %v %v", tt.method, tt.path, tt.op,
+				tt.status, rw.Code, rw.Body.String())
+		}
+	}
+	b.Fail = nil
+
+	// None of the failed operations created a second entry
+	ldrs := b.Loaders()
+	if len(ldrs) != 1 || ldrs[0].Enabled {
+		t.Fatalf("loaders after failed operations: %+v", ldrs)
+	}
+}
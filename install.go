@@ -0,0 +1,294 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/mozilla/mig"
+)
+
+// Scripts that install MIG along with a newly issued key
+
+// Quote s for use as a single word in a POSIX shell script
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Quote s for use as a string in a PowerShell script
+func psQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+var installFuncs = template.FuncMap{"sh": shellQuote, "ps": psQuote}
+
+var linuxInstallTmpl = `#!/bin/sh
+# Install MIG using the key issued for {{.Name}}. Run this script as root{{if not .Key}} from
+# the directory it was extracted to{{end}}.
+set -e
+
+if [ "$(id -u)" -ne 0 ]; then
+	echo "this script must be run as root" >&2
+	exit 1
+fi
+dir=$(cd "$(dirname "$0")" && pwd)
+
+# Select the package format used by this distribution
+if command -v dpkg >/dev/null 2>&1 && command -v apt-get >/dev/null 2>&1; then
+	pkgfile={{sh .DEB.File}}
+	pkgurl={{sh .DEB.URL}}
+elif command -v rpm >/dev/null 2>&1; then
+	pkgfile={{sh .RPM.File}}
+	pkgurl={{sh .RPM.URL}}
+else
+	echo "unable to determine the package format used by this system" >&2
+	exit 1
+fi
+
+{{if .Key -}}
+# Download the package
+pkg=""
+{{- else -}}
+# Use the package included with this script if there is one, otherwise download it
+pkg="$dir/$pkgfile"
+{{- end}}
+if [ ! -f "$pkg" ]; then
+	if [ -z "$pkgurl" ]; then
+		echo "no package is available for this system" >&2
+		exit 1
+	fi
+	tmp=$(mktemp -d)
+	trap 'rm -rf "$tmp"' EXIT
+	pkg="$tmp/$pkgfile"
+	if command -v curl >/dev/null 2>&1; then
+		curl -fsSL -o "$pkg" "$pkgurl"
+	else
+		wget -q -O "$pkg" "$pkgurl"
+	fi
+fi
+case "$pkgfile" in
+*.deb)
+	dpkg -i "$pkg"
+	;;
+*)
+	rpm -U --replacepkgs "$pkg"
+	;;
+esac
+
+mkdir -p /etc/mig
+{{if .Key -}}
+(umask 077 && printf '%s' {{sh .Key}} > /etc/mig/mig-loader.key)
+{{- else -}}
+(umask 077 && cp "$dir/mig-loader.key" /etc/mig/mig-loader.key)
+{{- end}}
+chmod 0600 /etc/mig/mig-loader.key
+
+# Run the loader daily to install the agent and keep it up to date, using a systemd
+# timer if systemd is in use and cron otherwise
+if [ -d /run/systemd/system ]; then
+	cat > /etc/systemd/system/mig-loader.service <<'UNIT'
+[Unit]
+Description=MIG loader
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=/sbin/mig-loader
+UNIT
+	cat > /etc/systemd/system/mig-loader.timer <<'UNIT'
+[Unit]
+Description=Run the MIG loader daily
+
+[Timer]
+OnBootSec=15min
+OnUnitActiveSec=1d
+RandomizedDelaySec=1h
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+UNIT
+	systemctl daemon-reload
+	systemctl enable mig-loader.timer
+	systemctl start mig-loader.timer
+elif [ -d /etc/cron.d ]; then
+	schedule=$(awk 'BEGIN { srand(); print int(rand() * 60), int(rand() * 24) }')
+	echo "$schedule * * * root /sbin/mig-loader >/dev/null 2>&1" > /etc/cron.d/mig-loader
+	chmod 0644 /etc/cron.d/mig-loader
+else
+	echo "neither systemd nor cron was found, schedule /sbin/mig-loader to run daily" >&2
+fi
+
+/sbin/mig-loader
+echo "MIG has been installed"
+`
+
+var osxInstallTmpl = `#!/bin/sh
+# Install MIG using the key issued for {{.Name}}. Open this file from the
+# directory it was extracted to; you will be asked for your password.
+set -e
+
+dir=$(cd "$(dirname "$0")" && pwd)
+if [ "$(id -u)" -ne 0 ]; then
+	exec sudo "$dir/$(basename "$0")" "$@"
+fi
+
+pkgfile={{sh .OSX.File}}
+pkg="$dir/$pkgfile"
+if [ ! -f "$pkg" ]; then
+	tmp=$(mktemp -d)
+	trap 'rm -rf "$tmp"' EXIT
+	pkg="$tmp/$pkgfile"
+	curl -fsSL -o "$pkg" {{sh .OSX.URL}}
+fi
+
+mkdir -p /etc/mig
+(umask 077 && cp "$dir/mig-loader.key" /etc/mig/mig-loader.key)
+chmod 0600 /etc/mig/mig-loader.key
+
+case "$pkgfile" in
+*.pkg)
+	installer -pkg "$pkg" -target /
+	;;
+*)
+	open -W "$pkg"
+	;;
+esac
+echo "MIG has been installed"
+`
+
+var windowsInstallTmpl = `# Install MIG using the key issued for {{.Name}}. Run install.cmd from the
+# directory this script was extracted to.
+$ErrorActionPreference = "Stop"
+
+$dir = Split-Path -Parent $MyInvocation.MyCommand.Path
+$installer = Join-Path $dir {{ps .Win.File}}
+if (-not (Test-Path $installer)) {
+    $installer = Join-Path $env:TEMP {{ps .Win.File}}
+    Invoke-WebRequest -UseBasicParsing -Uri {{ps .Win.URL}} -OutFile $installer
+}
+
+New-Item -ItemType Directory -Force -Path 'C:\mig' | Out-Null
+Copy-Item -Force (Join-Path $dir 'mig-loader.key') 'C:\mig\mig-loader.key'
+icacls 'C:\mig\mig-loader.key' /inheritance:r /grant:r 'SYSTEM:F' 'Administrators:F' | Out-Null
+
+if ($installer.EndsWith('.msi')) {
+    Start-Process -Wait -FilePath msiexec.exe -ArgumentList @('/i', ('"' + $installer + '"'))
+} else {
+    Start-Process -Wait -FilePath $installer
+}
+Write-Host 'MIG has been installed'
+`
+
+// Runs install.ps1 with administrative rights. The path is quoted for the elevated
+// PowerShell, as %~dp0 may contain spaces.
+var windowsInstallCmd = "@echo off\r\n" +
+	"powershell.exe -NoProfile -Command \"Start-Process -Verb RunAs -Wait powershell.exe " +
+	"-ArgumentList '-NoProfile','-ExecutionPolicy','Bypass','-File','\\\"%~dp0install.ps1\\\"'\"\r\n"
+
+// The location of an installer package
+type installerRef struct {
+	URL  string // URL the installer is downloaded from
+	File string // File name of the installer
+}
+
+// Return a reference to the installer at u, using def as the file name if one
+// can't be determined from the URL
+func newInstallerRef(u string, def string) installerRef {
+	ret := installerRef{URL: u, File: def}
+	pu, err := url.Parse(u)
+	if err != nil {
+		return ret
+	}
+	b := path.Base(pu.Path)
+	if b != "." && b != "/" && !strings.ContainsAny(b, "'\"\\") {
+		ret.File = b
+	}
+	return ret
+}
+
+// Data used to render the install scripts
+type installData struct {
+	Name string // Name of the loader entry the key was issued for
+	Key  string // The key, if it is included in the script rather than a key file
+	RPM  installerRef
+	DEB  installerRef
+	OSX  installerRef
+	Win  installerRef
+}
+
+func newInstallData(le mig.LoaderEntry) installData {
+	// The name appears in comments, so must not be able to end the line
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, le.Name)
+	return installData{
+		Name: name,
+		RPM:  newInstallerRef(cfg.DownloadLinuxRPM, "mig-agent.rpm"),
+		DEB:  newInstallerRef(cfg.DownloadLinuxDEB, "mig-agent.deb"),
+		OSX:  newInstallerRef(cfg.DownloadOSX, "mig-agent.pkg"),
+		Win:  newInstallerRef(cfg.DownloadWin, "mig-agent.exe"),
+	}
+}
+
+func renderInstallScript(name string, tmpl string, data installData) ([]byte, error) {
+	var outbuf bytes.Buffer
+
+	t, err := template.New(name).Funcs(installFuncs).Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	err = t.Execute(&outbuf, data)
+	if err != nil {
+		return nil, err
+	}
+	return outbuf.Bytes(), nil
+}
+
+// Serve a Linux install script including the key for the token in the request
+func handleLinuxInstall(rw http.ResponseWriter, req *http.Request) {
+	if cfg.DownloadLinuxRPM == "" && cfg.DownloadLinuxDEB == "" {
+		writeError(rw, req, errNotFound("no installer is configured for Linux", nil))
+		return
+	}
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		writeError(rw, req, errBadRequest("a key retrieval token is required", nil))
+		return
+	}
+	le, err := redeemKeyToken(req, token)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+	key, err := loaderKeyFile(le)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	data := newInstallData(le)
+	data.Key = string(key)
+	buf, err := renderInstallScript("linux.sh", linuxInstallTmpl, data)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	rw.Header().Set("Content-Type", "text/x-shellscript")
+	rw.Header().Set("Content-Disposition", "attachment; filename=\"mig-install-linux.sh\"")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.Write(buf)
+}
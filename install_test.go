@@ -0,0 +1,124 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mozilla/mig"
+)
+
+// Set the installer download URLs for the duration of the test
+func useDownloads(t *testing.T, rpm, deb, osx, win string) {
+	oldRPM, oldDEB, oldOSX, oldWin := cfg.DownloadLinuxRPM, cfg.DownloadLinuxDEB, cfg.DownloadOSX, cfg.DownloadWin
+	cfg.DownloadLinuxRPM, cfg.DownloadLinuxDEB, cfg.DownloadOSX, cfg.DownloadWin = rpm, deb, osx, win
+	t.Cleanup(func() {
+		cfg.DownloadLinuxRPM, cfg.DownloadLinuxDEB, cfg.DownloadOSX, cfg.DownloadWin = oldRPM, oldDEB, oldOSX, oldWin
+	})
+}
+
+func TestWindowsInstallScript(t *testing.T) {
+	useDownloads(t, "", "", "", "https://example.com/dl/mig-agent-1.0.msi")
+	data := newInstallData(mig.LoaderEntry{Name: "migss-user@example.com-1\r\nWrite-Host x"})
+	buf, err := renderInstallScript("install.ps1", windowsInstallTmpl, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(buf)
+	for _, want := range []string{
+		"# Install MIG using the key issued for migss-user@example.com-1Write-Host x. Run",
+		"$installer = Join-Path $dir 'mig-agent-1.0.msi'\n",
+		"-Uri 'https://example.com/dl/mig-agent-1.0.msi' -OutFile $installer\n",
+		"Copy-Item -Force (Join-Path $dir 'mig-loader.key') 'C:\\mig\\mig-loader.key'\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("install.ps1 does not contain %q:\n%v", want, s)
+		}
+	}
+
+	// Values are quoted as PowerShell strings
+	useDownloads(t, "", "", "", "https://example.com/dl/o'brien.exe")
+	buf, err = renderInstallScript("install.ps1", windowsInstallTmpl, newInstallData(mig.LoaderEntry{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf), "-Uri 'https://example.com/dl/o''brien.exe'") ||
+		!strings.Contains(string(buf), "Join-Path $dir 'mig-agent.exe'") {
+		t.Errorf("install.ps1 with a quote in the URL:\n%v", string(buf))
+	}
+
+	// The path to install.ps1 is quoted for the elevated PowerShell, so it may
+	// contain spaces
+	if !strings.Contains(windowsInstallCmd, `'-File','\"%~dp0install.ps1\"'"`+"\r\n") ||
+		!strings.HasPrefix(windowsInstallCmd, "@echo off\r\n") {
+		t.Errorf("install.cmd: got %q", windowsInstallCmd)
+	}
+}
+
+func TestLinuxInstallScript(t *testing.T) {
+	useMemoryBackend(t)
+	r := installRouter(t)
+	useDownloads(t, "https://example.com/dl/mig-agent-1.0.rpm", "", "", "")
+	user := "user@example.com"
+
+	rw := serveAs(t, r, user, "GET", "/install/linux.sh", "")
+	if rw.Code != 400 || errorCode(t, rw) != errCodeBadRequest {
+		t.Fatalf("no token: got %v %v", rw.Code, rw.Body.String())
+	}
+	token, le := vaultKey(t, user)
+	rw = serveAs(t, r, "other@example.com", "GET", "/install/linux.sh?token="+token, "")
+	if rw.Code != 404 {
+		t.Fatalf("another user's token: got %v %v", rw.Code, rw.Body.String())
+	}
+	rw = serveAs(t, r, user, "GET", "/install/linux.sh?token="+token, "")
+	if rw.Code != 200 {
+		t.Fatalf("linux.sh: got %v %v", rw.Code, rw.Body.String())
+	}
+	s := rw.Body.String()
+	for _, want := range []string{
+		"#!/bin/sh\n",
+		"\tpkgfile='mig-agent-1.0.rpm'\n\tpkgurl='https://example.com/dl/mig-agent-1.0.rpm'\n",
+		"\tpkgfile='mig-agent.deb'\n\tpkgurl=''\n",
+		"# Download the package\npkg=\"\"\n",
+		"(umask 077 && printf '%s' '" + le.Prefix + le.Key + "' > /etc/mig/mig-loader.key)\n",
+		"chmod 0600 /etc/mig/mig-loader.key\n",
+		"systemctl enable mig-loader.timer\n",
+		"/etc/cron.d/mig-loader\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("linux.sh does not contain %q:\n%v", want, s)
+		}
+	}
+	rw = serveAs(t, r, user, "GET", "/install/linux.sh?token="+token, "")
+	if rw.Code != 404 {
+		t.Fatalf("repeated linux.sh: got %v %v", rw.Code, rw.Body.String())
+	}
+
+	// The script included in a bundle uses the key file and package alongside it
+	data := newInstallData(le)
+	buf, err := renderInstallScript("install.sh", linuxInstallTmpl, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"pkg=\"$dir/$pkgfile\"\n",
+		"(umask 077 && cp \"$dir/mig-loader.key\" /etc/mig/mig-loader.key)\n",
+	} {
+		if !strings.Contains(string(buf), want) {
+			t.Errorf("install.sh does not contain %q:\n%v", want, string(buf))
+		}
+	}
+	if strings.Contains(string(buf), le.Key) {
+		t.Error("install.sh holds the key")
+	}
+
+	useDownloads(t, "", "", "", "")
+	rw = serveAs(t, r, user, "GET", "/install/linux.sh?token=x", "")
+	if rw.Code != 404 {
+		t.Fatalf("no linux installer: got %v %v", rw.Code, rw.Body.String())
+	}
+}
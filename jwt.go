@@ -0,0 +1,166 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// The header of a JSON web token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// Claims included in a JSON web token
+type jwtClaims map[string]interface{}
+
+// Return the string value of claim name, or an empty string if it is not present
+func (c jwtClaims) str(name string) string {
+	v, ok := c[name].(string)
+	if !ok {
+		return ""
+	}
+	return v
+}
+
+// Return the time value of numeric claim name
+func (c jwtClaims) time(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// Returns true if the audience of the token includes aud
+func (c jwtClaims) hasAudience(aud string) bool {
+	switch v := c["aud"].(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, x := range v {
+			if s, ok := x.(string); ok && s == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check the time based claims in the token; exp is required, nbf and iat are
+// checked if present. skew is the allowed clock difference.
+func (c jwtClaims) validateTimes(skew time.Duration) error {
+	now := time.Now()
+	exp, ok := c.time("exp")
+	if !ok {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.After(exp.Add(skew)) {
+		return fmt.Errorf("token has expired")
+	}
+	if nbf, ok := c.time("nbf"); ok && now.Add(skew).Before(nbf) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	if iat, ok := c.time("iat"); ok && now.Add(skew).Before(iat) {
+		return fmt.Errorf("token issued in the future")
+	}
+	return nil
+}
+
+// Look up the key that should be used to verify a token with the supplied header
+type jwtKeyFunc func(jwtHeader) (interface{}, error)
+
+// Parse a compact serialized JSON web token, verify the signature using the key
+// returned by keyfn and return the claims. Only RS256 signatures are supported.
+// The caller is responsible for validating the claims.
+func parseJWT(token string, keyfn jwtKeyFunc) (hdr jwtHeader, claims jwtClaims, err error) {
+	args := strings.Split(token, ".")
+	if len(args) != 3 {
+		return hdr, claims, fmt.Errorf("malformed token")
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(args[0])
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &hdr)
+	if err != nil {
+		return
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(args[2])
+	if err != nil {
+		return
+	}
+	key, err := keyfn(hdr)
+	if err != nil {
+		return
+	}
+	signed := []byte(args[0] + "." + args[1])
+	switch hdr.Alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return hdr, claims, fmt.Errorf("no RSA key available for token")
+		}
+		h := sha256.Sum256(signed)
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig)
+		if err != nil {
+			return hdr, claims, fmt.Errorf("invalid token signature")
+		}
+	default:
+		return hdr, claims, fmt.Errorf("unsupported token algorithm %q", hdr.Alg)
+	}
+	buf, err = base64.RawURLEncoding.DecodeString(args[1])
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &claims)
+	return
+}
+
+// A JSON web key set, as published by an OpenID provider
+type jwkSet struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// Return the RSA signing keys in the key set, indexed by key ID
+func (j *jwkSet) rsaKeys() (map[string]*rsa.PublicKey, error) {
+	ret := make(map[string]*rsa.PublicKey)
+	for _, k := range j.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		nbuf, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		ebuf, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		e := new(big.Int).SetBytes(ebuf)
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid exponent in key %v", k.Kid)
+		}
+		ret[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(nbuf), E: int(e.Int64())}
+	}
+	return ret, nil
+}
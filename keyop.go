@@ -0,0 +1,320 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	gcontext "github.com/gorilla/context"
+	"github.com/mozilla/mig"
+)
+
+// Issuing a key takes more than one call to the MIG API. Each key operation either
+// completes, returning an enabled entry along with the key, or leaves the entry
+// disabled, so a key the user has never seen is not left active. Steps that can be
+// safely repeated are retried by the API client if the API could not be reached.
+
+// Return the context used for the MIG API requests made by a key operation. Once
+// started a key operation is not abandoned if the client goes away, since that could
+// leave an entry half changed, but it is limited to the lifetime of the lock held
+// for the operation.
+func keyOpContext(req *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(req.Context()), stateConf.LockTTL)
+}
+
+// Return an error for a failed key operation, describing the outcome to the user
+func errKeyOp(cause error, msg string) error {
+	ret := errMIG(cause).(*portalError)
+	ret.message = msg
+	return ret
+}
+
+// Create a new loader entry for le and enable it. If the request to create the entry
+// fails the entry may still have been created, so the user's entries are fetched
+// again and if the entry exists it is rekeyed rather than created a second time.
+func createKey(cli migClient, rdetails *requestDetails, le mig.LoaderEntry, ev *auditEvent) (mig.LoaderEntry, error) {
+	newle, err := cli.PostNewLoader(le)
+	if err == nil {
+		ev.setLoader(newle)
+		return enableKey(cli, newle, ev)
+	}
+	rdetails.loaders = nil
+	if ferr := rdetails.addKeys(cli); ferr != nil {
+		log.Printf("unable to check for loader %v after failed create: %v", le.Name, ferr)
+		return le, errKeyOp(err, "the key could not be created, please try again")
+	}
+	existing, found, ferr := rdetails.slotLoader(le.Name)
+	if ferr != nil {
+		return le, ferr
+	}
+	if !found {
+		return le, errKeyOp(err, "the key could not be created, please try again")
+	}
+	log.Printf("loader %v (id %.0f) exists after failed create, rekeying", existing.Name, existing.ID)
+	ev.setLoader(existing)
+	return rekeyLoader(cli, existing, ev)
+}
+
+// Generate a new key for an existing loader entry and enable it. The key is changed
+// before the entry is enabled, so a disabled entry is never enabled with its
+// previous key. If the request for a new key fails the key may still have been
+// changed, so the entry is disabled, unless the request was never sent to MIG.
+func rekeyLoader(cli migClient, le mig.LoaderEntry, ev *auditEvent) (mig.LoaderEntry, error) {
+	newle, err := cli.LoaderEntryKey(le)
+	if err != nil && requestNotSent(err) {
+		ev.Reason = "rekey failed, entry unchanged"
+		return le, errKeyOp(err, "the key could not be changed, please try again")
+	}
+	if err != nil {
+		return le, rollbackKey(cli, le, ev, "rekey", err, "the key could not be changed")
+	}
+	return enableKey(cli, newle, ev)
+}
+
+// Enable a loader entry that has just been issued a key. If the entry can't be
+// enabled it is disabled, since the user will not be given the key.
+func enableKey(cli migClient, le mig.LoaderEntry, ev *auditEvent) (mig.LoaderEntry, error) {
+	err := cli.LoaderEntryStatus(le, true)
+	if err == nil {
+		le.Enabled = true
+		return le, nil
+	}
+	return le, rollbackKey(cli, le, ev, "enable", err, "the key could not be activated")
+}
+
+// Disable a loader entry after step of a key operation failed with err, returning
+// the error for the operation; msg describes the failure to the user
+func rollbackKey(cli migClient, le mig.LoaderEntry, ev *auditEvent, step string, err error, msg string) error {
+	rerr := cli.LoaderEntryStatus(le, false)
+	if rerr != nil {
+		log.Printf("unable to disable loader %v (id %.0f) after failed %v: %v", le.Name, le.ID, step, rerr)
+		ev.Reason = step + " failed, rollback failed"
+		return errKeyOp(err, msg+" and the slot could not be reset, please contact an administrator")
+	}
+	ev.Reason = step + " failed, rolled back"
+	return errKeyOp(err, msg+" and the slot has been disabled, please try again")
+}
+
+// Issue a key for the slot with loader name name, creating the loader entry if the
+// user does not have one for the slot and rekeying it if they do. If replace is
+// false a slot that already holds an enabled key is left unchanged. The key is kept
+// in the vault, and the token to retrieve it returned.
+func issueKey(req *http.Request, rdetails *requestDetails, name string, replace bool) (ret newkeyReply, err error) {
+	if ir, ok := keyOpReplay(req); ok {
+		if ir.Reply == nil {
+			return ret, errInternal(fmt.Errorf("no result stored for repeated key operation"))
+		}
+		return *ir.Reply, nil
+	}
+	ctx, cancel := keyOpContext(req)
+	defer cancel()
+	cli, err := newMIGClient(ctx)
+	if err != nil {
+		return ret, errInternal(err)
+	}
+	// Add any existing loader entries for this user to rdetails
+	err = rdetails.addKeys(cli)
+	if err != nil {
+		return ret, errMIG(err)
+	}
+
+	// Check and see if an entry for this slot already exists. If so we will enable
+	// and rekey this entry rather than create it.
+	existing, found, err := rdetails.slotLoader(name)
+	if err != nil {
+		return ret, err
+	}
+	if found && existing.Enabled && !replace {
+		return ret, errConflict("a key is already assigned to this slot", nil)
+	}
+	ev := newAuditEvent(req, rdetails.remoteUser, auditCreate)
+	var newle mig.LoaderEntry
+	if found {
+		ev.Action = auditRekey
+		ev.setLoader(existing)
+		newle, err = rekeyLoader(cli, existing, &ev)
+	} else {
+		le := mig.LoaderEntry{Name: name, ExpectEnv: cfg.ExpectEnv}
+		ev.setLoader(le)
+		newle, err = createKey(cli, rdetails, le, &ev)
+	}
+	if err != nil {
+		auditor.failure(ev, err)
+		return ret, err
+	}
+	auditor.success(ev)
+	reaper.keyIssued(newle.Name)
+	ret.Name = newle.Name
+	ret.Token, ret.Expires, err = vault.put(rdetails.remoteUser, newle)
+	if err != nil {
+		return ret, errInternal(err)
+	}
+	gcontext.Set(req, keyOpResultKey, ret)
+	return ret, nil
+}
+
+// Disable the loader entry for the slot with loader name name
+func removeKey(req *http.Request, rdetails *requestDetails, name string) error {
+	if _, ok := keyOpReplay(req); ok {
+		return nil
+	}
+	ctx, cancel := keyOpContext(req)
+	defer cancel()
+	cli, err := newMIGClient(ctx)
+	if err != nil {
+		return errInternal(err)
+	}
+	err = rdetails.addKeys(cli)
+	if err != nil {
+		return errMIG(err)
+	}
+	// We need the loader ID to change the status of the entry, locate the ID
+	// in rdetails based on our loader name
+	le, found, err := rdetails.slotLoader(name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errNotFound("no key is assigned to this slot", nil)
+	}
+	ev := newAuditEvent(req, rdetails.remoteUser, auditDisable)
+	ev.setLoader(le)
+	err = cli.LoaderEntryStatus(le, false)
+	if err != nil {
+		auditor.failure(ev, err)
+		return errMIG(err)
+	}
+	auditor.success(ev)
+	return nil
+}
+
+// Header clients can use to make a key operation idempotent
+const idempotencyHeader = "Idempotency-Key"
+
+// The longest idempotency key accepted
+const maxIdempotencyKey = 255
+
+// The outcome of a successful key operation, stored so a repeated request with the
+// same idempotency key can be answered without performing the operation again.
+// Only the token used to retrieve an issued key is kept, never the key itself. The
+// fingerprint identifies the request the outcome was for.
+type idempotentResponse struct {
+	Fingerprint string       `json:"fingerprint"`
+	Reply       *newkeyReply `json:"reply,omitempty"`
+}
+
+type keyOpContextKey int
+
+const (
+	keyOpResultKey keyOpContextKey = iota // The reply for a key issued by the request
+	keyOpReplayKey                        // The stored outcome of the operation the request repeats
+)
+
+// Return the stored outcome if the request repeats a completed key operation
+func keyOpReplay(req *http.Request) (*idempotentResponse, bool) {
+	ir, ok := gcontext.Get(req, keyOpReplayKey).(*idempotentResponse)
+	return ir, ok
+}
+
+// Acquire the lock held while the loader entries of user are changed, so changes
+// made by the user and by administrators are performed one at a time
+func lockUserKeys(user string) (release func(), err error) {
+	release, err = shared.lock("user:"+user, stateConf.LockTTL, stateConf.LockWait)
+	if err == errLockTimeout {
+		return nil, errConflict("another key operation is in progress, please try again", err)
+	} else if err != nil {
+		return nil, errUnavailable("key operations are currently unavailable, please try again later", err)
+	}
+	return release, nil
+}
+
+// Wraps handlers for key operations so a user's operations are performed one at a
+// time, across all portal instances sharing the state store. If the request includes
+// an Idempotency-Key header the outcome of a successful operation is kept, and any
+// repeat of the request is answered from it rather than performing the operation
+// again.
+func serializeKeyOp(h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rdetails, err := newRequestDetails(req)
+		if err != nil {
+			writeError(rw, req, errUnauthorized("no valid identity for request", err))
+			return
+		}
+		idem := req.Header.Get(idempotencyHeader)
+		if len(idem) > maxIdempotencyKey {
+			writeError(rw, req, errBadRequest("idempotency key is too long", nil))
+			return
+		}
+		release, err := lockUserKeys(rdetails.remoteUser)
+		if err != nil {
+			writeError(rw, req, err)
+			return
+		}
+		defer release()
+		if idem == "" {
+			h(rw, req)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeError(rw, req, errBadRequest("invalid request", err))
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		fp := sha256.Sum256(append([]byte(req.Method+" "+req.URL.Path+"\n"), body...))
+		sk := sha256.Sum256([]byte(rdetails.remoteUser + "\n" + idem))
+		skey := "idempotency:" + hex.EncodeToString(sk[:])
+		v, found, err := shared.get(skey)
+		if err != nil {
+			writeError(rw, req, errUnavailable("key operations are currently unavailable, please try again later", err))
+			return
+		}
+		if found {
+			var ir idempotentResponse
+			err = json.Unmarshal([]byte(v), &ir)
+			if err != nil {
+				writeError(rw, req, errInternal(err))
+				return
+			}
+			if ir.Fingerprint != hex.EncodeToString(fp[:]) {
+				writeError(rw, req, errConflict("the idempotency key has already been used for a different request", nil))
+				return
+			}
+			rw.Header().Set("Idempotent-Replayed", "true")
+			gcontext.Set(req, keyOpReplayKey, &ir)
+			h(rw, req)
+			return
+		}
+
+		sr := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		h(sr, req)
+		// Only successful operations are kept; a failed operation leaves nothing
+		// half done, so it is safe to perform it again
+		if sr.status < 200 || sr.status > 299 {
+			return
+		}
+		ir := idempotentResponse{Fingerprint: hex.EncodeToString(fp[:])}
+		if reply, ok := gcontext.Get(req, keyOpResultKey).(newkeyReply); ok {
+			ir.Reply = &reply
+		}
+		buf, err := json.Marshal(&ir)
+		if err == nil {
+			err = shared.set(skey, string(buf), stateConf.IdempotencyTTL)
+		}
+		if err != nil {
+			log.Printf("unable to store outcome of idempotent request %v: %v", requestID(req), err)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mozilla/mig"
+	"github.com/mozilla/mig-selfservice/migmem"
+)
+
+// A backend that performs an operation but then reports it failed, as happens if
+// the response from the API is lost
+type failAfterBackend struct {
+	*migmem.Backend
+	op string
+}
+
+var errLostResponse = &migmem.Error{Status: 500, Message: "response lost"}
+
+func (f *failAfterBackend) PostNewLoader(le mig.LoaderEntry) (mig.LoaderEntry, error) {
+	newle, err := f.Backend.PostNewLoader(le)
+	if err == nil && f.op == "PostNewLoader" {
+		return mig.LoaderEntry{}, errLostResponse
+	}
+	return newle, err
+}
+
+func (f *failAfterBackend) LoaderEntryKey(le mig.LoaderEntry) (mig.LoaderEntry, error) {
+	newle, err := f.Backend.LoaderEntryKey(le)
+	if err == nil && f.op == "LoaderEntryKey" {
+		return mig.LoaderEntry{}, errLostResponse
+	}
+	return newle, err
+}
+
+// Fail the first n status changes
+func failStatus(b *migmem.Backend, n int) {
+	calls := 0
+	b.Fail = func(op string) error {
+		if op != "LoaderEntryStatus" {
+			return nil
+		}
+		calls++
+		if calls > n {
+			return nil
+		}
+		return &migmem.Error{Status: 500, Message: "injected failure"}
+	}
+}
+
+// Inject a failure at each step of a key operation, checking the state the entry
+// is left in and the error returned
+func TestKeyOpFailures(t *testing.T) {
+	user := "user@example.com"
+	tests := []struct {
+		name     string
+		existing bool // The slot already has an enabled entry
+		after    string
+		status   int // Number of status changes to fail
+		msg      string
+		enabled  bool
+	}{
+		{name: "create fails after the entry is created", after: "PostNewLoader", enabled: true},
+		{name: "rekey fails after the key is changed", existing: true, after: "LoaderEntryKey",
+			msg: "the key could not be changed and the slot has been disabled, please try again"},
+		{name: "enable fails for a new entry", status: 1,
+			msg: "the key could not be activated and the slot has been disabled, please try again"},
+		{name: "enable fails for an existing entry", existing: true, status: 1,
+			msg: "the key could not be activated and the slot has been disabled, please try again"},
+		{name: "enable and rollback fail for a new entry", status: 2,
+			msg: "the key could not be activated and the slot could not be reset, please contact an administrator"},
+		// The entry is left enabled with a key the user has not seen; this is
+		// reported so an administrator can reset the slot
+		{name: "enable and rollback fail for an existing entry", existing: true, status: 2, enabled: true,
+			msg: "the key could not be activated and the slot could not be reset, please contact an administrator"},
+	}
+	for _, tt := range tests {
+		b := useMemoryBackend(t)
+		r := keyRouter(t)
+		var prefix string
+		if tt.existing {
+			newKey(t, r, user, "slot1")
+			prefix = b.Loaders()[0].Prefix
+		}
+		if tt.after != "" {
+			memBackend = &failAfterBackend{Backend: b, op: tt.after}
+		}
+		failStatus(b, tt.status)
+
+		rw := serveAs(t, r, user, "POST", "/newkey", `{"slot":"slot1"}`)
+		if tt.msg == "" {
+			var reply newkeyReply
+			if rw.Code != 200 || json.Unmarshal(rw.Body.Bytes(), &reply) != nil {
+				t.Fatalf("%v: got %v %v", tt.name, rw.Code, rw.Body.String())
+			}
+			rw = serveAs(t, r, user, "GET", "/key/"+reply.Token, "")
+			var kr keyReply
+			if rw.Code != 200 || json.Unmarshal(rw.Body.Bytes(), &kr) != nil {
+				t.Fatalf("%v: key retrieval got %v %v", tt.name, rw.Code, rw.Body.String())
+			}
+			if !strings.HasPrefix(kr.Key, b.Loaders()[0].Prefix) {
+				t.Errorf("%v: key %v does not match the entry", tt.name, kr.Key)
+			}
+		} else {
+			var er errorReply
+			if rw.Code != 502 || json.Unmarshal(rw.Body.Bytes(), &er) != nil || er.Message != tt.msg {
+				t.Errorf("%v: got %v %v", tt.name, rw.Code, rw.Body.String())
+			}
+		}
+
+		ldrs := b.Loaders()
+		if len(ldrs) != 1 {
+			t.Fatalf("%v: %v entries exist for the slot", tt.name, len(ldrs))
+		}
+		if ldrs[0].Enabled != tt.enabled {
+			t.Errorf("%v: entry enabled is %v, want %v", tt.name, ldrs[0].Enabled, tt.enabled)
+		}
+		if tt.existing && ldrs[0].Prefix == prefix {
+			t.Errorf("%v: entry was not rekeyed", tt.name)
+		}
+	}
+}
+
+// A repeated request with the same idempotency key is answered from the stored
+// outcome, which holds the token for the key but not the key
+func TestKeyOpIdempotency(t *testing.T) {
+	b := useMemoryBackend(t)
+	r := keyRouter(t)
+	user := "user@example.com"
+	m := shared.(*memoryStore)
+
+	newkey := func(idem string, slot string) *httptest.ResponseRecorder {
+		return serveAs(t, r, user, "POST", "/newkey", `{"slot":"`+slot+`"}`, idempotencyHeader, idem)
+	}
+	rw := newkey("k1", "slot1")
+	var reply newkeyReply
+	if rw.Code != 200 || json.Unmarshal(rw.Body.Bytes(), &reply) != nil {
+		t.Fatalf("newkey: got %v %v", rw.Code, rw.Body.String())
+	}
+	prefix := b.Loaders()[0].Prefix
+	rw = serveAs(t, r, user, "GET", "/key/"+reply.Token, "")
+	var kr keyReply
+	if rw.Code != 200 || json.Unmarshal(rw.Body.Bytes(), &kr) != nil {
+		t.Fatalf("key retrieval: got %v %v", rw.Code, rw.Body.String())
+	}
+	for k, v := range m.values {
+		if strings.Contains(v.value, kr.Key[len(prefix):]) {
+			t.Fatalf("state store value %v holds the key", k)
+		}
+	}
+
+	rw = newkey("k1", "slot1")
+	var replayed newkeyReply
+	if rw.Code != 200 || json.Unmarshal(rw.Body.Bytes(), &replayed) != nil {
+		t.Fatalf("repeated newkey: got %v %v", rw.Code, rw.Body.String())
+	}
+	if rw.Header().Get("Idempotent-Replayed") != "true" || replayed != reply {
+		t.Fatalf("repeated newkey not replayed: got %v", rw.Body.String())
+	}
+	if b.Loaders()[0].Prefix != prefix {
+		t.Fatal("repeated newkey rekeyed the entry")
+	}
+	rw = newkey("k1", "slot2")
+	if rw.Code != 409 {
+		t.Fatalf("idempotency key reused for another slot: got %v %v", rw.Code, rw.Body.String())
+	}
+
+	// A repeated delkey does not contact MIG
+	rw = serveAs(t, r, user, "POST", "/delkey", `{"slot":"slot1"}`, idempotencyHeader, "k2")
+	if rw.Code != 200 {
+		t.Fatalf("delkey: got %v %v", rw.Code, rw.Body.String())
+	}
+	b.Fail = func(op string) error { return &migmem.Error{Status: 500, Message: "injected failure"} }
+	rw = serveAs(t, r, user, "POST", "/delkey", `{"slot":"slot1"}`, idempotencyHeader, "k2")
+	if rw.Code != 200 || rw.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("repeated delkey: got %v %v", rw.Code, rw.Body.String())
+	}
+}
+
+// A rekey request that was never sent to MIG leaves the entry as it was
+func TestRekeyNotSent(t *testing.T) {
+	b := useMemoryBackend(t)
+	r := keyRouter(t)
+	user := "user@example.com"
+	newKey(t, r, user, "slot1")
+	prefix := b.Loaders()[0].Prefix
+	b.Fail = func(op string) error {
+		if op == "LoaderEntryKey" {
+			return errBreakerOpen
+		}
+		return nil
+	}
+	rw := serveAs(t, r, user, "POST", "/newkey", `{"slot":"slot1"}`)
+	var er errorReply
+	if rw.Code != 503 || json.Unmarshal(rw.Body.Bytes(), &er) != nil ||
+		er.Message != "the key could not be changed, please try again" {
+		t.Fatalf("rekey with the breaker open: got %v %v", rw.Code, rw.Body.String())
+	}
+	if le := b.Loaders()[0]; !le.Enabled || le.Prefix != prefix {
+		t.Fatalf("entry changed by a rekey that was not sent: %+v", le)
+	}
+}
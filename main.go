@@ -10,21 +10,22 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-yaml/yaml"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 	"github.com/mozilla/mig"
-	"github.com/mozilla/mig/client"
-	migdbsearch "github.com/mozilla/mig/database/search"
 )
 
 type config struct {
+	Backend          string // MIG backend, api (the default) or memory
 	APIUrl           string
 	APIKey           string
 	SkipVerifyCert   bool
@@ -33,7 +34,74 @@ type config struct {
 	DownloadLinuxRPM string
 	DownloadLinuxDEB string
 	DownloadOSX      string
+	InstallerCache   string // Directory holding copies of the installers to include in bundles
 	FakeRemote       string
+	OIDC             oidcConfig
+	Proxy            proxyConfig
+	Audit            auditConfig
+	Reaper           reaperConfig
+	Listen           listenConfig
+	APIClient        apiClientConfig
+	State            stateConfig
+	RateLimit        rateLimitConfig
+	KeyRetrievalTTL  time.Duration // How long a new key can be retrieved, default 10m
+	Tokens           tokenConfig
+	CSRFKey          string   // Key used to generate CSRF tokens
+	AllowedOrigins   []string // Additional origins permitted to submit requests
+	SecureCookies    bool     // Set the secure flag on cookies
+
+	// Number of key slots available to each user; SlotQuota applies to
+	// everyone and can be raised or lowered for specific users or for
+	// members of groups listed in Groups. A user override takes precedence
+	// over group overrides, and if a user is in more than one group with
+	// an override the largest value is used.
+	SlotQuota      int
+	UserSlotQuota  map[string]int
+	GroupSlotQuota map[string]int
+	Groups         map[string][]string
+
+	// Users, and groups from Groups, permitted to use the administrative interface
+	AdminUsers  []string
+	AdminGroups []string
+}
+
+// The number of slots available if SlotQuota is not set in the configuration
+const defaultSlotQuota = 3
+
+// Return the names of the groups the user is a member of
+func userGroups(user string) (ret []string) {
+	for g, members := range cfg.Groups {
+		for _, x := range members {
+			if x == user {
+				ret = append(ret, g)
+				break
+			}
+		}
+	}
+	return
+}
+
+// Return the number of key slots that are available to user
+func slotQuota(user string) int {
+	if v, ok := cfg.UserSlotQuota[user]; ok {
+		return v
+	}
+	ret := cfg.SlotQuota
+	if ret == 0 {
+		ret = defaultSlotQuota
+	}
+	found := false
+	for _, g := range userGroups(user) {
+		v, ok := cfg.GroupSlotQuota[g]
+		if !ok {
+			continue
+		}
+		if !found || v > ret {
+			ret = v
+			found = true
+		}
+	}
+	return ret
 }
 
 var cfg config
@@ -45,6 +113,18 @@ const remoteUser remoteUserType = 0
 // Response to a key status request
 type loadersReply struct {
 	Loaders []mig.LoaderEntry `json:"loaders"`
+	Agents  []slotAgent       `json:"agents"`
+}
+
+// Describes the most recent agent enrolled using the loader entry in a slot
+type slotAgent struct {
+	Slot        int       `json:"slot"`
+	Hostname    string    `json:"hostname"`
+	OS          string    `json:"os"`
+	Arch        string    `json:"arch"`
+	Version     string    `json:"version"`
+	HeartBeatTS time.Time `json:"heartbeatts"`
+	Status      string    `json:"status"`
 }
 
 // Payload submitted for a new key request
@@ -58,56 +138,149 @@ func (n *newkeyRequest) validate() error {
 
 type requestDetails struct {
 	remoteUser string
+	slots      int
 	loaders    []mig.LoaderEntry
+	csrfToken  string
 }
 
+// Escape characters in s that would otherwise be treated as wildcards when used
+// in a LIKE pattern by the MIG API
+func escapeLike(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "_", "\\_", -1)
+	return strings.Replace(s, "%", "\\%", -1)
+}
+
+// Return the loader name search string for the user. Note that this is only used to
+// narrow down the results returned by the API; the search parameters convert some
+// characters that are valid in an email address (such as +) into wildcards, and the
+// API compares names without regard to case, so the results must still be checked
+// with ownsLoader.
 func (r *requestDetails) searchUserString() string {
-	return "migss-" + r.remoteUser + "-%"
+	return "migss-" + escapeLike(r.remoteUser) + "-%"
 }
 
-func (r *requestDetails) convertSlotID(slotid string) (string, error) {
-	ret := "migss-" + r.remoteUser + "-"
+// Return the slot number a loader name refers to, if the name is exactly of the form
+// migss-<user>-<n> for the user associated with the request
+func (r *requestDetails) loaderSlot(name string) (int, error) {
+	prefix := "migss-" + r.remoteUser + "-"
+	if !strings.HasPrefix(name, prefix) {
+		return 0, fmt.Errorf("loader name does not match user")
+	}
+	sv := strings.TrimPrefix(name, prefix)
+	if sv == "" || sv[0] == '0' {
+		return 0, fmt.Errorf("invalid slot in loader name")
+	}
+	for _, c := range sv {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid slot in loader name")
+		}
+	}
+	ret, err := strconv.Atoi(sv)
+	if err != nil {
+		return 0, err
+	}
+	return ret, nil
+}
+
+// Returns true if the loader entry belongs to the user associated with the request
+func (r *requestDetails) ownsLoader(le mig.LoaderEntry) bool {
+	_, err := r.loaderSlot(le.Name)
+	return err == nil
+}
+
+// Return the loader name for a slot id submitted in a request. Slots above the user's
+// quota are only accepted if inQuota is false, so entries left in slots beyond a
+// quota that has since been lowered can still be disabled.
+func (r *requestDetails) convertSlotID(slotid string, inQuota bool) (string, error) {
 	sv := strings.Replace(slotid, "slot", "", 1)
 	svint, err := strconv.ParseInt(sv, 10, 64)
 	if err != nil {
 		return "", err
 	}
-	if (svint < 1) || (svint > 3) {
+	if (svint < 1) || (inQuota && svint > int64(r.slots)) {
 		return "", fmt.Errorf("invalid slot id")
 	}
-	ret = ret + sv
-	return ret, nil
+	return r.slotName(int(svint)), nil
 }
 
-func (r *requestDetails) addKeys(cli client.Client) error {
-	p := migdbsearch.NewParameters()
-	p.Type = "loader"
-	p.LoaderName = r.searchUserString()
-	resources, err := cli.GetAPIResource("search?" + p.String())
-	if err != nil {
-		// Determine if it was a 404, if so this isn't an error and just return
-		if strings.Contains(err.Error(), "HTTP 404") {
-			return nil
+// Return the loader name for slot
+func (r *requestDetails) slotName(slot int) string {
+	return "migss-" + r.remoteUser + "-" + strconv.Itoa(slot)
+}
+
+// Return the loader entry with loader name name, or found false if the user has no
+// entry for the slot. More than one entry for a slot is reported as a conflict.
+func (r *requestDetails) slotLoader(name string) (ret mig.LoaderEntry, found bool, err error) {
+	for _, x := range r.loaders {
+		if x.Name != name {
+			continue
+		}
+		if found {
+			return mig.LoaderEntry{}, false, errConflict("more than one loader entry exists for this slot, contact an administrator",
+				fmt.Errorf("duplicate loader entries for %v", name))
 		}
+		ret = x
+		found = true
+	}
+	return
+}
+
+func (r *requestDetails) addKeys(cli migClient) error {
+	ldrs, err := searchLoaders(cli, r.searchUserString())
+	if err != nil {
 		return err
 	}
-	for _, x := range resources.Collection.Items {
-		for _, y := range x.Data {
-			if y.Name != "loader" {
-				continue
-			}
-			le, err := client.ValueToLoaderEntry(y.Value)
-			if err != nil {
-				return err
-			}
-			r.loaders = append(r.loaders, le)
+	for _, le := range ldrs {
+		// The search is a pattern match, so discard anything returned that
+		// does not belong to this user
+		if !r.ownsLoader(le) {
+			log.Printf("ignoring loader %q (id %.0f) returned in search for %v",
+				le.Name, le.ID, r.remoteUser)
+			continue
 		}
+		r.loaders = append(r.loaders, le)
 	}
 	return r.validate()
 }
 
+// Return the most recent agent for each of the loader entries in the request. Agent
+// details are informational, so if the lookup fails for a slot it is just omitted.
+func (r *requestDetails) slotAgents(cli migClient) (ret []slotAgent) {
+	ret = make([]slotAgent, 0)
+	for _, le := range r.loaders {
+		slot, err := r.loaderSlot(le.Name)
+		if err != nil {
+			continue
+		}
+		agts, err := searchLoaderAgents(cli, le)
+		if err != nil {
+			log.Printf("agent lookup for loader %v failed: %v", le.Name, err)
+			continue
+		}
+		if len(agts) == 0 {
+			continue
+		}
+		ret = append(ret, slotAgent{
+			Slot:        slot,
+			Hostname:    agts[0].Name,
+			OS:          agts[0].Env.OS,
+			Arch:        agts[0].Env.Arch,
+			Version:     agts[0].Version,
+			HeartBeatTS: agts[0].HeartBeatTS,
+			Status:      agts[0].Status,
+		})
+	}
+	return
+}
+
 func (r *requestDetails) validate() error {
-	match, err := regexp.MatchString("^[a-zA-Z0-9_.+-]+@[a-zA-Z0-9-]+\\.[a-zA-Z0-9-.]+$", r.remoteUser)
+	return validUser(r.remoteUser)
+}
+
+// Check user is an email address, which the portal uses to identify users
+func validUser(user string) error {
+	match, err := regexp.MatchString("^[a-zA-Z0-9_.+-]+@[a-zA-Z0-9-]+\\.[a-zA-Z0-9-.]+$", user)
 	if err != nil {
 		return err
 	}
@@ -129,18 +302,28 @@ func newRequestDetails(req *http.Request) (ret requestDetails, err error) {
 	if !ok {
 		return ret, fmt.Errorf("invalid remoteUser")
 	}
-	return ret, ret.validate()
+	err = ret.validate()
+	if err != nil {
+		return
+	}
+	ret.slots = slotQuota(ret.remoteUser)
+	return
 }
 
 func handleMain(rw http.ResponseWriter, req *http.Request) {
 	rdetails, err := newRequestDetails(req)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, errUnauthorized("no valid identity for request", err))
+		return
+	}
+	rdetails.csrfToken, err = csrfToken(rw, req, rdetails.remoteUser)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
 		return
 	}
 	mp, err := renderMainPage(rdetails)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, errInternal(err))
 		return
 	}
 	fmt.Fprint(rw, mp)
@@ -149,17 +332,17 @@ func handleMain(rw http.ResponseWriter, req *http.Request) {
 func handleKeyStatus(rw http.ResponseWriter, req *http.Request) {
 	rdetails, err := newRequestDetails(req)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, errUnauthorized("no valid identity for request", err))
 		return
 	}
-	cli, err := newMIGClient()
+	cli, err := newMIGClient(req.Context())
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, errInternal(err))
 		return
 	}
 	err = rdetails.addKeys(cli)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, errMIG(err))
 		return
 	}
 	resp := loadersReply{}
@@ -167,9 +350,10 @@ func handleKeyStatus(rw http.ResponseWriter, req *http.Request) {
 	if resp.Loaders == nil {
 		resp.Loaders = make([]mig.LoaderEntry, 0)
 	}
+	resp.Agents = rdetails.slotAgents(cli)
 	buf, err := json.Marshal(&resp)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, errInternal(err))
 		return
 	}
 	rw.Header().Set("Content-Type", "application/json")
@@ -177,14 +361,11 @@ func handleKeyStatus(rw http.ResponseWriter, req *http.Request) {
 }
 
 func handleNewKey(rw http.ResponseWriter, req *http.Request) {
-	var (
-		newkey newkeyRequest
-		le     mig.LoaderEntry
-	)
+	var newkey newkeyRequest
 
 	rdetails, err := newRequestDetails(req)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, errUnauthorized("no valid identity for request", err))
 		return
 	}
 
@@ -192,64 +373,22 @@ func handleNewKey(rw http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	err = decoder.Decode(&newkey)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, errBadRequest("invalid request", err))
 		return
 	}
-
-	cli, err := newMIGClient()
+	name, err := rdetails.convertSlotID(newkey.SlotID, true)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, errBadRequest("invalid slot", err))
 		return
 	}
-	// Add any existing loader entries for this user to rdetails
-	err = rdetails.addKeys(cli)
-
-	le.Name, err = rdetails.convertSlotID(newkey.SlotID)
+	reply, err := issueKey(req, &rdetails, name, true)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, err)
 		return
 	}
-	le.ExpectEnv = cfg.ExpectEnv
-
-	// At this point the loader is ready to be created, but first check and see if an
-	// entry for this slot already exists. If so we will enable and rekey this entry
-	// rather than create it.
-	var newle mig.LoaderEntry
-	found := false
-	for _, x := range rdetails.loaders {
-		if x.Name == le.Name {
-			newle = x
-			found = true
-			break
-		}
-	}
-	if found {
-		err = cli.LoaderEntryStatus(newle, true)
-		if err != nil {
-			http.Error(rw, err.Error(), 500)
-			return
-		}
-		newle, err = cli.LoaderEntryKey(newle)
-		if err != nil {
-			http.Error(rw, err.Error(), 500)
-			return
-		}
-	} else {
-		newle, err = cli.PostNewLoader(le)
-		if err != nil {
-			http.Error(rw, err.Error(), 500)
-			return
-		}
-		// Also enable the new loader entry
-		err = cli.LoaderEntryStatus(newle, true)
-		if err != nil {
-			http.Error(rw, err.Error(), 500)
-			return
-		}
-	}
-	buf, err := json.Marshal(&newle)
+	buf, err := json.Marshal(&reply)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, errInternal(err))
 		return
 	}
 	rw.Header().Set("Content-Type", "application/json")
@@ -257,56 +396,28 @@ func handleNewKey(rw http.ResponseWriter, req *http.Request) {
 }
 
 func handleDelKey(rw http.ResponseWriter, req *http.Request) {
-	var (
-		newkey newkeyRequest
-		le     mig.LoaderEntry
-	)
+	var newkey newkeyRequest
 
 	rdetails, err := newRequestDetails(req)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, errUnauthorized("no valid identity for request", err))
 		return
 	}
 	decoder := json.NewDecoder(req.Body)
 	defer req.Body.Close()
 	err = decoder.Decode(&newkey)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
-		return
-	}
-	cli, err := newMIGClient()
-	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, errBadRequest("invalid request", err))
 		return
 	}
-	err = rdetails.addKeys(cli)
+	name, err := rdetails.convertSlotID(newkey.SlotID, false)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
+		writeError(rw, req, errBadRequest("invalid slot", err))
 		return
 	}
-	le.Name, err = rdetails.convertSlotID(newkey.SlotID)
+	err = removeKey(req, &rdetails, name)
 	if err != nil {
-		http.Error(rw, err.Error(), 500)
-		return
-	}
-	// We need the loader ID to change the status of the entry, locate the ID
-	// in rdetails based on our loader name and add it to the request
-	found := false
-	for _, x := range rdetails.loaders {
-		if x.Name == le.Name {
-			le.ID = x.ID
-			found = true
-			break
-		}
-	}
-	if !found {
-		http.Error(rw, "unable to locate loader ID for slot", 500)
-		return
-	}
-	err = cli.LoaderEntryStatus(le, false)
-	if err != nil {
-		http.Error(rw, err.Error(), 500)
-		return
+		writeError(rw, req, err)
 	}
 }
 
@@ -314,34 +425,48 @@ func handlePing(rw http.ResponseWriter, req *http.Request) {
 	fmt.Fprint(rw, "pong\n")
 }
 
-func newMIGClient() (ret client.Client, err error) {
-	var cconf client.Configuration
-	cconf.API.URL = cfg.APIUrl
-	cconf.API.SkipVerifyCert = cfg.SkipVerifyCert
-	cconf.GPG.UseAPIKeyAuth = cfg.APIKey
-
-	ret, err = client.NewClient(cconf, "mig-selfservice")
-	if err != nil {
-		return
-	}
+// Wraps handlers to identify the user making the request. Requests using a personal
+// access token are rejected; use setTokenContext for handlers that accept them.
+func setContext(h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return identify("", h)
+}
 
-	return
+// Wraps handlers to identify the user making the request, accepting requests that
+// use a personal access token granting scope
+func setTokenContext(scope string, h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return identify(scope, h)
 }
 
-func setContext(h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+func identify(scope string, h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var ru string
-		if cfg.FakeRemote != "" {
+		if token, ok := bearerToken(r); ok {
+			ru, ok = tokenAuth(w, r, token, scope)
+			if !ok {
+				return
+			}
+		} else if cfg.FakeRemote != "" {
 			ru = cfg.FakeRemote
-		} else {
-			hslice, ok := r.Header["REMOTE_USER"]
-			if !ok || len(hslice) != 1 {
-				http.Error(w, "invalid header configuration", 500)
+		} else if oidcProv != nil {
+			var err error
+			ru, err = oidcProv.sessionUser(r)
+			if err != nil {
+				oidcProv.unauthenticated(w, r)
 				return
 			}
-			ru = r.Header.Get("REMOTE_USER")
-			if ru == "" {
-				http.Error(w, "invalid header configuration", 500)
+		} else {
+			var err error
+			ru, err = trust.remoteUser(r)
+			if err != nil {
+				auditor.failure(newAuditEvent(r, r.Header.Get("REMOTE_USER"), auditAuthFailure), err)
+				pe, ok := err.(*proxyTrustError)
+				if !ok {
+					writeError(w, r, errUnauthorized("unable to verify identity", err))
+				} else if pe.status == http.StatusForbidden {
+					writeError(w, r, errForbidden(pe.msg, nil))
+				} else {
+					writeError(w, r, errUnauthorized(pe.msg, nil))
+				}
 				return
 			}
 		}
@@ -350,6 +475,22 @@ func setContext(h func(http.ResponseWriter, *http.Request)) func(http.ResponseWr
 	}
 }
 
+// Read and parse the configuration file
+func readConfig(confpath string) (ret config, err error) {
+	cfgbuf, err := ioutil.ReadFile(confpath)
+	if err != nil {
+		return
+	}
+	err = yaml.Unmarshal(cfgbuf, &ret)
+	return
+}
+
+// Load the configuration file into cfg
+func loadConfig(confpath string) (err error) {
+	cfg, err = readConfig(confpath)
+	return
+}
+
 func main() {
 	var (
 		err        error
@@ -357,35 +498,108 @@ func main() {
 		fakeremote string
 	)
 
+	if len(os.Args) > 1 && os.Args[1] == "offboard" {
+		os.Exit(runOffboard(os.Args[2:]))
+	}
+
 	flag.StringVar(&confpath, "c", "./mig-selfservice.yml", "path to configuration file")
 	flag.StringVar(&fakeremote, "r", "", "fake remote user for testing")
 	flag.Parse()
-	cfgbuf, err := ioutil.ReadFile(confpath)
+	err = loadConfig(confpath)
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
 		os.Exit(1)
 	}
-	err = yaml.Unmarshal(cfgbuf, &cfg)
+	if fakeremote != "" {
+		cfg.FakeRemote = fakeremote
+	}
+
+	err = auditor.init(cfg.Audit)
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
 		os.Exit(1)
 	}
-	if fakeremote != "" {
-		cfg.FakeRemote = fakeremote
+	err = csrfInit()
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	err = stateInit(cfg.State)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	err = tokensInit()
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	err = vaultInit()
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	err = trust.init(cfg.Proxy)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	if cfg.OIDC.Issuer != "" {
+		oidcProv, err = newOIDCProvider(cfg.OIDC, &http.Client{Timeout: 30 * time.Second})
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// The configuration is needed to record key issue times even if this instance
+	// does not run the reaper
+	reaper.conf = cfg.Reaper
+	if cfg.Reaper.Interval != 0 {
+		reaper.start()
 	}
 
 	r := mux.NewRouter()
 	r.HandleFunc("/ping", handlePing).Methods("GET")
+	r.HandleFunc("/metrics", handleMetrics).Methods("GET")
+	if oidcProv != nil {
+		r.HandleFunc("/login", oidcProv.handleLogin).Methods("GET")
+		r.HandleFunc("/oidc/callback", oidcProv.handleCallback).Methods("GET")
+		r.HandleFunc("/logout", setContext(csrfProtect(oidcProv.handleLogout))).Methods("POST")
+	}
 	r.HandleFunc("/", setContext(handleMain)).Methods("GET")
-	r.HandleFunc("/keystatus", setContext(handleKeyStatus)).Methods("GET")
-	r.HandleFunc("/newkey", setContext(handleNewKey)).Methods("POST")
-	r.HandleFunc("/delkey", setContext(handleDelKey)).Methods("POST")
+	r.HandleFunc("/keystatus", setTokenContext(scopeStatus, handleKeyStatus)).Methods("GET")
+	r.HandleFunc("/newkey", setTokenContext(scopeKeys, csrfProtect(rateLimit(trackKeyOp(serializeKeyOp(handleNewKey)))))).Methods("POST")
+	r.HandleFunc("/key/{token}", setTokenContext(scopeKeys, handleGetKey)).Methods("GET")
+	r.HandleFunc("/key/{token}/download", setTokenContext(scopeKeys, handleDownloadKey)).Methods("GET")
+	r.HandleFunc("/key/{token}/bundle/{os}", setTokenContext(scopeKeys, handleBundle)).Methods("GET")
+	r.HandleFunc("/install/linux.sh", setTokenContext(scopeKeys, handleLinuxInstall)).Methods("GET")
+	r.HandleFunc("/delkey", setTokenContext(scopeKeys, csrfProtect(rateLimit(trackKeyOp(serializeKeyOp(handleDelKey)))))).Methods("POST")
+	r.HandleFunc("/tokens", setContext(tokensEnabled(handleListTokens))).Methods("GET")
+	r.HandleFunc("/tokens", setContext(tokensEnabled(csrfProtect(handleCreateToken)))).Methods("POST")
+	r.HandleFunc("/tokens/{id}", setContext(tokensEnabled(csrfProtect(handleRevokeToken)))).Methods("DELETE")
+	err = addAPIRoutes(r)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	r.HandleFunc("/admin", setContext(adminOnly(handleAdmin))).Methods("GET")
+	r.HandleFunc("/admin/loaders", setContext(adminOnly(handleAdminLoaders))).Methods("GET")
+	r.HandleFunc("/admin/disable", setContext(adminOnly(csrfProtect(trackKeyOp(handleAdminDisable))))).Methods("POST")
+	r.HandleFunc("/admin/rekey", setContext(adminOnly(csrfProtect(trackKeyOp(handleAdminRekey))))).Methods("POST")
+	r.HandleFunc("/admin/offboard", setContext(adminOnly(csrfProtect(trackKeyOp(handleAdminOffboard))))).Methods("POST")
+
+	err = instrumentRoutes(r)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
 
 	sp := http.StripPrefix("/static/", http.FileServer(http.Dir("./static/")))
 	r.PathPrefix("/static").Handler(sp)
 
-	http.Handle("/", context.ClearHandler(r))
-	err = http.ListenAndServe(":2000", nil)
+	srv := newPortalServer(context.ClearHandler(withRequestID(r)), confpath)
+	err = srv.run(cfg.Listen)
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
 		os.Exit(1)
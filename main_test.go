@@ -0,0 +1,188 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	gcontext "github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/mozilla/mig"
+	"github.com/mozilla/mig-selfservice/migmem"
+)
+
+// Use a new in-memory MIG backend for the duration of the test
+func useMemoryBackend(t *testing.T) *migmem.Backend {
+	b := migmem.New()
+	oldBackend, oldMem := cfg.Backend, memBackend
+	cfg.Backend = "memory"
+	memBackend = b
+	t.Cleanup(func() {
+		cfg.Backend = oldBackend
+		memBackend = oldMem
+	})
+	return b
+}
+
+// Serve a request through r as user, identified by the FakeRemote setting so
+// handlers must be wrapped with setContext. hdr holds header names and values.
+func serveAs(t *testing.T, r *mux.Router, user string, method string, path string, body string,
+	hdr ...string) *httptest.ResponseRecorder {
+	old := cfg.FakeRemote
+	cfg.FakeRemote = user
+	defer func() { cfg.FakeRemote = old }()
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	for i := 0; i+1 < len(hdr); i += 2 {
+		req.Header.Set(hdr[i], hdr[i+1])
+	}
+	rw := httptest.NewRecorder()
+	gcontext.ClearHandler(r).ServeHTTP(rw, req)
+	return rw
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"user@x.com", "user@x.com"},
+		{"a_b@x.com", "a\\_b@x.com"},
+		{"a%b@x.com", "a\\%b@x.com"},
+		{"a\\b@x.com", "a\\\\b@x.com"},
+		{"a\\_%b", "a\\\\\\_\\%b"},
+	}
+	for _, tt := range tests {
+		if got := escapeLike(tt.in); got != tt.want {
+			t.Errorf("escapeLike(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// Slots above the quota can only be used to disable an existing entry
+func TestConvertSlotID(t *testing.T) {
+	r := requestDetails{remoteUser: "user@x.com", slots: 2}
+	tests := []struct {
+		slotid  string
+		inQuota bool
+		want    string
+	}{
+		{"slot1", true, "migss-user@x.com-1"},
+		{"slot2", true, "migss-user@x.com-2"},
+		{"slot3", true, ""},
+		{"slot3", false, "migss-user@x.com-3"},
+		{"slot0", false, ""},
+		{"slotx", false, ""},
+	}
+	for _, tt := range tests {
+		got, err := r.convertSlotID(tt.slotid, tt.inQuota)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("convertSlotID(%q, %v) = %q, %v, want %q", tt.slotid, tt.inQuota, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoaderSlot(t *testing.T) {
+	tests := []struct {
+		user   string
+		loader string
+		slot   int // 0 if the loader must not match the user
+	}{
+		{"a_b@x.com", "migss-a_b@x.com-1", 1},
+		{"a_b@x.com", "migss-a.b@x.com-1", 0},
+		{"a_b@x.com", "migss-aab@x.com-1", 0},
+		{"a.b@x.com", "migss-a_b@x.com-1", 0},
+		{"a.b@x.com", "migss-a.b@x.com-2", 2},
+		{"ab@x.com", "migss-a%b@x.com-1", 0},
+		{"axxb@x.com", "migss-a%b@x.com-1", 0},
+		{"a+b@x.com", "migss-a+b@x.com-1", 1},
+		{"a+b@x.com", "migss-a b@x.com-1", 0},
+		{"a+b@x.com", "migss-aab@x.com-1", 0},
+		{"ab@x.com", "migss-a\\b@x.com-1", 0},
+		{"user@x.com", "migss-USER@x.com-1", 0},
+		{"user@x.com", "migss-User@X.com-1", 0},
+		{"User@x.com", "migss-user@x.com-1", 0},
+		{"user@x.com", "migss-user@x.com-10", 10},
+		{"user@x.com", "migss-user@x.com-1-1", 0},
+		{"user@x.com-1", "migss-user@x.com-10", 0},
+		{"user@x.com-1", "migss-user@x.com-1-1", 1},
+		{"user@x.com", "migss-user@x.com-01", 0},
+		{"user@x.com", "migss-user@x.com-", 0},
+		{"user@x.com", "migss-user@x.com-1a", 0},
+		{"user@x.com", "migss-xuser@x.com-1", 0},
+	}
+	for _, tt := range tests {
+		r := requestDetails{remoteUser: tt.user}
+		slot, err := r.loaderSlot(tt.loader)
+		owns := r.ownsLoader(mig.LoaderEntry{Name: tt.loader})
+		if tt.slot == 0 {
+			if err == nil || owns {
+				t.Errorf("user %q matched loader %q (slot %v)", tt.user, tt.loader, slot)
+			}
+			continue
+		}
+		if err != nil || !owns || slot != tt.slot {
+			t.Errorf("user %q, loader %q: got slot %v, error %v, want slot %v",
+				tt.user, tt.loader, slot, err, tt.slot)
+		}
+	}
+}
+
+// Loaders for addresses that differ only in characters the API treats as wildcards
+// or compares without regard to case are all returned by a search for any one of
+// them, so check addKeys discards everything but the user's own entries
+func TestAddKeysOwnership(t *testing.T) {
+	b := useMemoryBackend(t)
+	owners := []string{
+		"a_b@x.com",
+		"a.b@x.com",
+		"aab@x.com",
+		"a%b@x.com",
+		"a+b@x.com",
+		"a b@x.com",
+		"a\\b@x.com",
+		"user@x.com",
+		"USER@x.com",
+		"user@x.com-1",
+	}
+	for _, o := range owners {
+		for _, slot := range []string{"1", "10"} {
+			_, err := b.PostNewLoader(mig.LoaderEntry{Name: "migss-" + o + "-" + slot})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	cli, err := newMIGClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []string{"a_b@x.com", "a.b@x.com", "a+b@x.com", "user@x.com", "USER@x.com", "user@x.com-1"}
+	for _, u := range users {
+		r := requestDetails{remoteUser: u}
+		err = r.addKeys(cli)
+		if err != nil {
+			t.Fatalf("addKeys for %v: %v", u, err)
+		}
+		if len(r.loaders) != 2 {
+			t.Errorf("addKeys for %v returned %v loaders, want 2", u, len(r.loaders))
+		}
+		for _, le := range r.loaders {
+			if le.Name != "migss-"+u+"-1" && le.Name != "migss-"+u+"-10" {
+				t.Errorf("addKeys for %v returned loader %v", u, le.Name)
+			}
+		}
+	}
+	// Addresses containing LIKE wildcards are not valid users
+	for _, u := range []string{"a%b@x.com", "a\\b@x.com"} {
+		r := requestDetails{remoteUser: u}
+		if r.addKeys(cli) == nil {
+			t.Errorf("addKeys for %v succeeded", u)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Metrics are exposed on /metrics in the Prometheus text format
+
+// Upper bounds of the buckets used for latency histograms, in seconds
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// How long the self-service loader counts are cached before being refreshed
+const loaderStatsTTL = time.Minute
+
+// Escape a label value for the text exposition format
+func escapeLabel(v string) string {
+	v = strings.Replace(v, "\\", "\\\\", -1)
+	v = strings.Replace(v, "\"", "\\\"", -1)
+	return strings.Replace(v, "\n", "\\n", -1)
+}
+
+// Format a set of label names and values as a label string, including extra
+// label pairs if supplied
+func formatLabels(names []string, values []string, extra ...string) string {
+	var pairs []string
+	for i := range names {
+		pairs = append(pairs, fmt.Sprintf("%v=\"%v\"", names[i], escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=\"%v\"", extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// A counter partitioned by a set of labels
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.Lock()
+	c.values[strings.Join(values, "\xff")]++
+	c.Unlock()
+}
+
+func (c *counterVec) write(buf *bytes.Buffer) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(buf, "# HELP %v %v\n# TYPE %v counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(buf, "%v%v %v\n", c.name,
+			formatLabels(c.labels, strings.Split(k, "\xff")), formatValue(c.values[k]))
+	}
+}
+
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// A histogram partitioned by a set of labels
+type histogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets,
+		values: make(map[string]*histogramValue)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	h.Lock()
+	defer h.Unlock()
+	k := strings.Join(values, "\xff")
+	hv, ok := h.values[k]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(buf, "# HELP %v %v\n# TYPE %v histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lv := strings.Split(k, "\xff")
+		hv := h.values[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(buf, "%v_bucket%v %v\n", h.name,
+				formatLabels(h.labels, lv, "le", formatValue(b)), hv.counts[i])
+		}
+		fmt.Fprintf(buf, "%v_bucket%v %v\n", h.name, formatLabels(h.labels, lv, "le", "+Inf"), hv.count)
+		fmt.Fprintf(buf, "%v_sum%v %v\n", h.name, formatLabels(h.labels, lv), formatValue(hv.sum))
+		fmt.Fprintf(buf, "%v_count%v %v\n", h.name, formatLabels(h.labels, lv), hv.count)
+	}
+}
+
+var (
+	httpRequests = newCounterVec("migss_http_requests_total",
+		"Requests handled by the portal.", "route", "method", "code")
+	httpLatency = newHistogramVec("migss_http_request_duration_seconds",
+		"Time taken to handle portal requests.", latencyBuckets, "route")
+	migCalls = newCounterVec("migss_mig_api_calls_total",
+		"Calls made to the MIG API.", "method")
+	migErrors = newCounterVec("migss_mig_api_errors_total",
+		"Calls made to the MIG API that failed.", "method")
+	migLatency = newHistogramVec("migss_mig_api_call_duration_seconds",
+		"Time taken by calls to the MIG API.", latencyBuckets, "method")
+	rateLimited = newCounterVec("migss_rate_limited_total",
+		"Key operations rejected because a rate limit was exceeded.", "limit")
+)
+
+// Record the result of a call to the MIG API that started at start
+func observeMIGCall(method string, start time.Time, err error) {
+	migCalls.inc(method)
+	migLatency.observe(time.Since(start).Seconds(), method)
+	if err != nil && !isNotFound(err) {
+		migErrors.inc(method)
+	}
+}
+
+// Wraps a ResponseWriter to record the status code of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Wrap h to record request metrics for route
+func instrument(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		h.ServeHTTP(sr, req)
+		httpRequests.inc(route, req.Method, strconv.Itoa(sr.status))
+		httpLatency.observe(time.Since(start).Seconds(), route)
+	})
+}
+
+// Wrap the handler of each route in the router to record request metrics
+func instrumentRoutes(r *mux.Router) error {
+	return r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		h := route.GetHandler()
+		if h == nil {
+			return nil
+		}
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		route.Handler(instrument(tpl, h))
+		return nil
+	})
+}
+
+// Cached counts of self-service loaders by state
+type loaderStats struct {
+	sync.Mutex
+	updated  time.Time
+	enabled  int
+	disabled int
+	valid    bool
+}
+
+var ldrStats loaderStats
+
+// Refresh the loader counts if the cached values have expired
+func (l *loaderStats) refresh() {
+	l.Lock()
+	defer l.Unlock()
+	if time.Since(l.updated) < loaderStatsTTL {
+		return
+	}
+	l.updated = time.Now()
+	cli, err := newMIGClient(context.Background())
+	if err != nil {
+		log.Printf("metrics: %v", err)
+		return
+	}
+	ldrs, err := allSelfServiceLoaders(cli)
+	if err != nil {
+		log.Printf("metrics: unable to count loaders: %v", err)
+		return
+	}
+	l.enabled = 0
+	l.disabled = 0
+	for _, x := range ldrs {
+		if x.Enabled {
+			l.enabled++
+		} else {
+			l.disabled++
+		}
+	}
+	l.valid = true
+}
+
+func (l *loaderStats) write(buf *bytes.Buffer) {
+	l.refresh()
+	l.Lock()
+	defer l.Unlock()
+	if !l.valid {
+		return
+	}
+	fmt.Fprintf(buf, "# HELP migss_loaders Self-service loader entries by state.\n")
+	fmt.Fprintf(buf, "# TYPE migss_loaders gauge\n")
+	fmt.Fprintf(buf, "migss_loaders{state=\"enabled\"} %v\n", l.enabled)
+	fmt.Fprintf(buf, "migss_loaders{state=\"disabled\"} %v\n", l.disabled)
+}
+
+// Write the state of the MIG API circuit breaker, if the API client has been created
+func writeBreakerState(buf *bytes.Buffer) {
+	sharedAPILock.Lock()
+	api := sharedAPI
+	sharedAPILock.Unlock()
+	if api == nil {
+		return
+	}
+	state := api.breaker.current()
+	fmt.Fprintf(buf, "# HELP migss_mig_api_breaker_state State of the MIG API circuit breaker.\n")
+	fmt.Fprintf(buf, "# TYPE migss_mig_api_breaker_state gauge\n")
+	for _, x := range []string{breakerClosed, breakerOpen, breakerHalfOpen} {
+		v := 0
+		if x == state {
+			v = 1
+		}
+		fmt.Fprintf(buf, "migss_mig_api_breaker_state{state=\"%v\"} %v\n", x, v)
+	}
+}
+
+func handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	httpRequests.write(&buf)
+	httpLatency.write(&buf)
+	migCalls.write(&buf)
+	migErrors.write(&buf)
+	migLatency.write(&buf)
+	rateLimited.write(&buf)
+	ldrStats.write(&buf)
+	writeBreakerState(&buf)
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.Write(buf.Bytes())
+}
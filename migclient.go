@@ -0,0 +1,337 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"context"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla/mig"
+	"github.com/mozilla/mig-selfservice/migmem"
+	"github.com/mozilla/mig/client"
+	migdbsearch "github.com/mozilla/mig/database/search"
+)
+
+// The loader operations on the MIG API used by the portal
+type migBackend interface {
+	// Perform a search, returning the values of the result data elements with
+	// the supplied name
+	Search(p migdbsearch.Parameters, name string) ([]interface{}, error)
+	PostNewLoader(le mig.LoaderEntry) (mig.LoaderEntry, error)
+	LoaderEntryStatus(le mig.LoaderEntry, status bool) error
+	LoaderEntryKey(le mig.LoaderEntry) (mig.LoaderEntry, error)
+	LoaderEntryExpect(le mig.LoaderEntry, eval string) error
+}
+
+// Settings for the client used to make requests to the MIG API
+type apiClientConfig struct {
+	Timeout          time.Duration // Time allowed for each request to the API, default 15s
+	MaxIdleConns     int           // Idle connections kept open to the API, default 20
+	Retries          int           // Retries for idempotent requests that fail to reach the API, default 2
+	RetryDelay       time.Duration // Delay before the first retry, doubled for each retry, default 200ms
+	BreakerThreshold int           // Consecutive failures before requests fail fast, default 5
+	BreakerCooldown  time.Duration // How long requests fail fast before the API is tried again, default 30s
+}
+
+const (
+	defaultAPITimeout       = 15 * time.Second
+	defaultAPIMaxIdleConns  = 20
+	defaultAPIRetries       = 2
+	defaultAPIRetryDelay    = 200 * time.Millisecond
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+func (a apiClientConfig) withDefaults() apiClientConfig {
+	if a.Timeout == 0 {
+		a.Timeout = defaultAPITimeout
+	}
+	if a.MaxIdleConns == 0 {
+		a.MaxIdleConns = defaultAPIMaxIdleConns
+	}
+	if a.Retries == 0 {
+		a.Retries = defaultAPIRetries
+	}
+	if a.RetryDelay == 0 {
+		a.RetryDelay = defaultAPIRetryDelay
+	}
+	if a.BreakerThreshold == 0 {
+		a.BreakerThreshold = defaultBreakerThreshold
+	}
+	if a.BreakerCooldown == 0 {
+		a.BreakerCooldown = defaultBreakerCooldown
+	}
+	return a
+}
+
+// Applies a context to each request made using the transport, so requests to the
+// API are abandoned when the request to the portal that made them is
+type ctxTransport struct {
+	base http.RoundTripper
+	ctx  context.Context
+}
+
+func (c *ctxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.base.RoundTrip(req.WithContext(c.ctx))
+}
+
+// A backend that uses the MIG API. A single client, and so a single pool of
+// connections, is shared by all requests; withContext returns a copy for use with
+// a particular request.
+type apiBackend struct {
+	client.Client
+	conf      apiClientConfig
+	transport http.RoundTripper
+	breaker   *circuitBreaker
+	ctx       context.Context
+}
+
+var (
+	sharedAPILock sync.Mutex
+	sharedAPI     *apiBackend
+)
+
+// Return the shared API backend, creating it if required
+func sharedAPIBackend() (*apiBackend, error) {
+	sharedAPILock.Lock()
+	defer sharedAPILock.Unlock()
+	if sharedAPI != nil {
+		return sharedAPI, nil
+	}
+	conf := cfg.APIClient.withDefaults()
+	var cconf client.Configuration
+	cconf.API.URL = cfg.APIUrl
+	cconf.API.SkipVerifyCert = cfg.SkipVerifyCert
+	cconf.GPG.UseAPIKeyAuth = cfg.APIKey
+
+	cli, err := client.NewClient(cconf, "mig-selfservice")
+	if err != nil {
+		return nil, err
+	}
+	// Keep the TLS settings the MIG client uses, but tune the transport for a
+	// long lived client shared by concurrent requests
+	tr, ok := cli.API.Transport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("unexpected transport type in MIG client")
+	}
+	tr.DialContext = (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	tr.MaxIdleConns = conf.MaxIdleConns
+	tr.MaxIdleConnsPerHost = conf.MaxIdleConns
+	tr.IdleConnTimeout = 90 * time.Second
+	tr.TLSHandshakeTimeout = 10 * time.Second
+	tr.ResponseHeaderTimeout = conf.Timeout
+	tr.ExpectContinueTimeout = time.Second
+	sharedAPI = &apiBackend{
+		Client:    cli,
+		conf:      conf,
+		transport: tr,
+		breaker:   newCircuitBreaker(conf.BreakerThreshold, conf.BreakerCooldown),
+		ctx:       context.Background(),
+	}
+	return sharedAPI, nil
+}
+
+// Return a copy of the backend that makes requests using ctx
+func (a apiBackend) withContext(ctx context.Context) apiBackend {
+	a.ctx = ctx
+	a.Client.API = &http.Client{
+		Transport: &ctxTransport{base: a.transport, ctx: ctx},
+		Timeout:   a.conf.Timeout,
+	}
+	return a
+}
+
+// Make a request using f, failing immediately if the circuit breaker is open. If
+// the request is idempotent and fails because the API could not be reached, it is
+// retried with backoff. A request that fails because the context was cancelled or
+// timed out is not retried or counted as a failure by the breaker.
+func (a apiBackend) call(idempotent bool, f func() error) (err error) {
+	delay := a.conf.RetryDelay
+	for i := 0; ; i++ {
+		err = a.breaker.allow()
+		if err != nil {
+			return err
+		}
+		err = f()
+		if err != nil && a.ctx.Err() != nil {
+			a.breaker.abandon()
+			return err
+		}
+		failed := err != nil && isUnavailable(err)
+		a.breaker.record(failed)
+		if !failed || !idempotent || i >= a.conf.Retries {
+			return err
+		}
+		// Add up to 50% jitter so retries from concurrent requests are spread out
+		wait := delay + time.Duration(mathrand.Int63n(int64(delay)/2+1))
+		select {
+		case <-a.ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+func (a apiBackend) Search(p migdbsearch.Parameters, name string) (ret []interface{}, err error) {
+	err = a.call(true, func() error {
+		resources, err := a.Client.GetAPIResource("search?" + p.String())
+		if err != nil {
+			return err
+		}
+		ret = nil
+		for _, x := range resources.Collection.Items {
+			for _, y := range x.Data {
+				if y.Name != name {
+					continue
+				}
+				ret = append(ret, y.Value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Creating a loader entry is not idempotent, so it is never retried
+func (a apiBackend) PostNewLoader(le mig.LoaderEntry) (newle mig.LoaderEntry, err error) {
+	err = a.call(false, func() (err error) {
+		newle, err = a.Client.PostNewLoader(le)
+		return
+	})
+	return
+}
+
+func (a apiBackend) LoaderEntryStatus(le mig.LoaderEntry, status bool) error {
+	return a.call(true, func() error {
+		return a.Client.LoaderEntryStatus(le, status)
+	})
+}
+
+// Each request for a key generates a new one, replacing any key generated by an
+// earlier attempt, so the request can be repeated
+// Returned in place of an error for a request that failed before it was sent to the
+// API, so it can't have had any effect
+type notSentError struct {
+	err error
+}
+
+func (n *notSentError) Error() string {
+	return n.err.Error()
+}
+
+// Returns true if err shows a request was not made to the API
+func requestNotSent(err error) bool {
+	if err == errBreakerOpen {
+		return true
+	}
+	_, ok := err.(*notSentError)
+	return ok
+}
+
+// Changing the key of an entry that has not been enabled is undone by disabling
+// it, which is only needed if the request may have reached the API; so if none of
+// the attempts were sent the error is returned as a notSentError.
+func (a apiBackend) LoaderEntryKey(le mig.LoaderEntry) (newle mig.LoaderEntry, err error) {
+	var sent int32
+	b := a.withContext(httptrace.WithClientTrace(a.ctx, &httptrace.ClientTrace{
+		WroteHeaders: func() { atomic.StoreInt32(&sent, 1) },
+	}))
+	err = b.call(true, func() (err error) {
+		newle, err = b.Client.LoaderEntryKey(le)
+		return
+	})
+	if err != nil && err != errBreakerOpen && atomic.LoadInt32(&sent) == 0 {
+		err = &notSentError{err}
+	}
+	return
+}
+
+func (a apiBackend) LoaderEntryExpect(le mig.LoaderEntry, eval string) error {
+	return a.call(true, func() error {
+		return a.Client.LoaderEntryExpect(le, eval)
+	})
+}
+
+// The backend used if Backend is set to memory in the configuration, which keeps
+// loader entries in memory for the lifetime of the process. This can be replaced
+// with any other backend, such as a wrapper that injects failures.
+var memBackend migBackend = migmem.New()
+
+// Wraps the MIG backend to record metrics for the API calls made by the portal
+type migClient struct {
+	migBackend
+}
+
+// Return a client for the backend selected in the configuration. Requests to the
+// MIG API made using the client are abandoned if ctx is cancelled.
+func newMIGClient(ctx context.Context) (ret migClient, err error) {
+	switch cfg.Backend {
+	case "", "api":
+		api, err := sharedAPIBackend()
+		if err != nil {
+			return ret, err
+		}
+		ret.migBackend = api.withContext(ctx)
+	case "memory":
+		ret.migBackend = memBackend
+	default:
+		err = fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+	return
+}
+
+// Returns true if err indicates the API returned a 404, which the API uses to
+// indicate a search returned no results
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "HTTP 404")
+}
+
+func (m migClient) Search(p migdbsearch.Parameters, name string) ([]interface{}, error) {
+	start := time.Now()
+	ret, err := m.migBackend.Search(p, name)
+	observeMIGCall("GetAPIResource", start, err)
+	return ret, err
+}
+
+func (m migClient) PostNewLoader(le mig.LoaderEntry) (mig.LoaderEntry, error) {
+	start := time.Now()
+	newle, err := m.migBackend.PostNewLoader(le)
+	observeMIGCall("PostNewLoader", start, err)
+	return newle, err
+}
+
+func (m migClient) LoaderEntryStatus(le mig.LoaderEntry, status bool) error {
+	start := time.Now()
+	err := m.migBackend.LoaderEntryStatus(le, status)
+	observeMIGCall("LoaderEntryStatus", start, err)
+	return err
+}
+
+func (m migClient) LoaderEntryKey(le mig.LoaderEntry) (mig.LoaderEntry, error) {
+	start := time.Now()
+	newle, err := m.migBackend.LoaderEntryKey(le)
+	observeMIGCall("LoaderEntryKey", start, err)
+	return newle, err
+}
+
+func (m migClient) LoaderEntryExpect(le mig.LoaderEntry, eval string) error {
+	start := time.Now()
+	err := m.migBackend.LoaderEntryExpect(le, eval)
+	observeMIGCall("LoaderEntryExpect", start, err)
+	return err
+}
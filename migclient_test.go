@@ -0,0 +1,132 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mozilla/mig"
+)
+
+func TestAPICallRetry(t *testing.T) {
+	newBackend := func(ctx context.Context) apiBackend {
+		return apiBackend{
+			conf:    apiClientConfig{Retries: 2, RetryDelay: time.Millisecond},
+			breaker: newCircuitBreaker(10, time.Minute),
+			ctx:     ctx,
+		}
+	}
+	unavailable := fmt.Errorf("HTTP 503: unavailable")
+	tests := []struct {
+		idempotent bool
+		err        error
+		calls      int
+	}{
+		{true, nil, 1},
+		{true, unavailable, 3},
+		{false, unavailable, 1},
+		{true, fmt.Errorf("HTTP 500: server error"), 1},
+		{true, fmt.Errorf("HTTP 404: not found"), 1},
+	}
+	for _, tt := range tests {
+		a := newBackend(context.Background())
+		calls := 0
+		err := a.call(tt.idempotent, func() error {
+			calls++
+			return tt.err
+		})
+		if err != tt.err || calls != tt.calls {
+			t.Errorf("call(%v) returning %v: got %v after %v calls, want %v calls",
+				tt.idempotent, tt.err, err, calls, tt.calls)
+		}
+	}
+
+	// Retries stop once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	a := newBackend(ctx)
+	calls := 0
+	a.call(true, func() error {
+		calls++
+		return unavailable
+	})
+	if calls != 1 {
+		t.Errorf("call retried after the context was cancelled: %v calls", calls)
+	}
+
+	// Requests abandoned by the caller don't open the breaker
+	a.breaker = newCircuitBreaker(1, time.Minute)
+	for i := 0; i < 3; i++ {
+		a.call(true, func() error { return unavailable })
+	}
+	if st := a.breaker.current(); st != breakerClosed {
+		t.Errorf("breaker %v after cancelled requests", st)
+	}
+	// A cancelled probe allows another to be made
+	a.breaker.record(true)
+	a.breaker.openedAt = time.Time{}
+	a.call(true, func() error { return unavailable })
+	if err := a.breaker.allow(); err != nil {
+		t.Errorf("probe not allowed after a cancelled probe: %v", err)
+	}
+
+	// Once the breaker opens no further requests are made
+	a = newBackend(context.Background())
+	a.breaker = newCircuitBreaker(2, time.Minute)
+	calls = 0
+	err := a.call(true, func() error {
+		calls++
+		return unavailable
+	})
+	if calls != 2 || err != errBreakerOpen {
+		t.Errorf("call with breaker threshold 2: got %v after %v calls", err, calls)
+	}
+}
+
+// A rekey request is reported as not sent only if it never reached the API
+func TestLoaderEntryKeyNotSent(t *testing.T) {
+	useAPIServer(t)
+	// Accept the request, then drop the connection without a response
+	hangup := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, _, err := rw.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer hangup.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + ln.Addr().String() + "/api/v1/"
+	ln.Close()
+
+	tests := []struct {
+		url     string
+		notSent bool
+	}{
+		{refused, true},
+		{hangup.URL + "/api/v1/", false},
+	}
+	for _, tt := range tests {
+		cfg.APIUrl = tt.url
+		sharedAPI = nil
+		a, err := sharedAPIBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = a.withContext(context.Background()).LoaderEntryKey(mig.LoaderEntry{ID: 1})
+		if err == nil || requestNotSent(err) != tt.notSent {
+			t.Errorf("%v: got %v, not sent %v", tt.url, err, requestNotSent(err))
+		}
+	}
+}
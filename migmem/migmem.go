@@ -0,0 +1,284 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+
+// Package migmem is an in-memory implementation of the MIG API loader operations
+// used by the self-service portal, for use in tests and demonstrations where no MIG
+// deployment is available.
+package migmem
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mozilla/mig"
+	migdbsearch "github.com/mozilla/mig/database/search"
+)
+
+// Backend stores loader entries and agents in memory
+type Backend struct {
+	sync.Mutex
+	loaders []mig.LoaderEntry
+	agents  []mig.Agent
+	nextID  float64
+
+	// If Fail is set it is called with the name of the operation before each
+	// operation is performed; if it returns an error the operation fails with
+	// that error. This can be used to inject failures.
+	Fail func(op string) error
+}
+
+// New returns an empty backend
+func New() *Backend {
+	return &Backend{nextID: 1}
+}
+
+// Error is returned when an operation fails, and records the status code the API
+// would have responded with
+type Error struct {
+	Status  int
+	Message string
+}
+
+// Errors are formatted the same way as the errors returned by the MIG client, so
+// callers that inspect the status code in the message behave the same way
+func (e *Error) Error() string {
+	return fmt.Sprintf("error: HTTP %d. API call failed with error '%v' (code 0)", e.Status, e.Message)
+}
+
+func apiError(status int, msg string) error {
+	return &Error{Status: status, Message: msg}
+}
+
+// Returns true if err was returned because a search had no results, or the loader
+// entry an operation referred to does not exist
+func IsNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "HTTP 404")
+}
+
+func (b *Backend) fail(op string) error {
+	if b.Fail == nil {
+		return nil
+	}
+	return b.Fail(op)
+}
+
+// Return the index of the loader entry with the supplied ID; must be called with
+// the lock held
+func (b *Backend) loaderIndex(id float64) (int, error) {
+	for i := range b.loaders {
+		if b.loaders[i].ID == id {
+			return i, nil
+		}
+	}
+	return 0, apiError(404, fmt.Sprintf("loader entry %.0f not found", id))
+}
+
+// Returns true if s matches the SQL ILIKE pattern, where % matches any sequence of
+// characters, _ matches a single character and \ escapes the following character
+func matchLike(pattern string, s string) bool {
+	p := []rune(strings.ToLower(pattern))
+	v := []rune(strings.ToLower(s))
+	var match func(pi, vi int) bool
+	match = func(pi, vi int) bool {
+		for pi < len(p) {
+			switch p[pi] {
+			case '%':
+				for i := vi; i <= len(v); i++ {
+					if match(pi+1, i) {
+						return true
+					}
+				}
+				return false
+			case '_':
+				if vi >= len(v) {
+					return false
+				}
+			case '\\':
+				if pi+1 < len(p) {
+					pi++
+				}
+				fallthrough
+			default:
+				if vi >= len(v) || v[vi] != p[pi] {
+					return false
+				}
+			}
+			pi++
+			vi++
+		}
+		return vi == len(v)
+	}
+	return match(0, 0)
+}
+
+// Search returns the loader entries or agents matching the search parameters. Only
+// the parameters the portal uses are considered; for loaders the name and ID, and for
+// agents the name. name is the name of the data element the API would return the
+// results in, and must match the search type. As with the API, keys are never
+// returned and a search with no results returns an error.
+func (b *Backend) Search(p migdbsearch.Parameters, name string) ([]interface{}, error) {
+	if err := b.fail("Search"); err != nil {
+		return nil, err
+	}
+	b.Lock()
+	defer b.Unlock()
+	if name != p.Type {
+		return nil, apiError(400, fmt.Sprintf("unsupported result type %v", name))
+	}
+	var ret []interface{}
+	switch p.Type {
+	case "loader":
+		for _, le := range b.loaders {
+			if p.LoaderID != "∞" && p.LoaderID != strconv.FormatFloat(le.ID, 'f', 0, 64) {
+				continue
+			}
+			if !matchLike(p.LoaderName, le.Name) {
+				continue
+			}
+			le.Key = ""
+			ret = append(ret, le)
+		}
+	case "agent":
+		for _, agt := range b.agents {
+			if !matchLike(p.AgentName, agt.Name) {
+				continue
+			}
+			ret = append(ret, agt)
+		}
+	default:
+		return nil, apiError(400, fmt.Sprintf("unsupported search type %v", p.Type))
+	}
+	off := int(p.Offset)
+	if off > len(ret) {
+		off = len(ret)
+	}
+	ret = ret[off:]
+	if p.Limit > 0 && len(ret) > int(p.Limit) {
+		ret = ret[:int(p.Limit)]
+	}
+	if len(ret) == 0 {
+		return nil, apiError(404, "no results found")
+	}
+	return ret, nil
+}
+
+// PostNewLoader creates a new loader entry, generating a key for it. As with the
+// API the entry is created disabled.
+func (b *Backend) PostNewLoader(le mig.LoaderEntry) (mig.LoaderEntry, error) {
+	if err := b.fail("PostNewLoader"); err != nil {
+		return mig.LoaderEntry{}, err
+	}
+	if le.Prefix != "" || le.Key != "" {
+		return mig.LoaderEntry{}, fmt.Errorf("loader key and prefix must be unset")
+	}
+	if le.Name == "" {
+		return mig.LoaderEntry{}, apiError(400, "loader name must be set")
+	}
+	b.Lock()
+	defer b.Unlock()
+	le.ID = b.nextID
+	b.nextID++
+	le.Prefix = mig.GenerateLoaderPrefix()
+	le.Key = mig.GenerateLoaderKey()
+	le.AgentName = ""
+	le.LastSeen = time.Now().UTC()
+	le.Enabled = false
+	stored := le
+	stored.Key = ""
+	b.loaders = append(b.loaders, stored)
+	return le, nil
+}
+
+// LoaderEntryStatus enables or disables a loader entry
+func (b *Backend) LoaderEntryStatus(le mig.LoaderEntry, status bool) error {
+	if err := b.fail("LoaderEntryStatus"); err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	i, err := b.loaderIndex(le.ID)
+	if err != nil {
+		return err
+	}
+	b.loaders[i].Enabled = status
+	return nil
+}
+
+// LoaderEntryKey generates a new key for a loader entry, returning the entry
+// including the new key
+func (b *Backend) LoaderEntryKey(le mig.LoaderEntry) (mig.LoaderEntry, error) {
+	if err := b.fail("LoaderEntryKey"); err != nil {
+		return mig.LoaderEntry{}, err
+	}
+	b.Lock()
+	defer b.Unlock()
+	i, err := b.loaderIndex(le.ID)
+	if err != nil {
+		return mig.LoaderEntry{}, err
+	}
+	b.loaders[i].Prefix = mig.GenerateLoaderPrefix()
+	ret := b.loaders[i]
+	ret.Key = mig.GenerateLoaderKey()
+	return ret, nil
+}
+
+// LoaderEntryExpect sets the expected environment for a loader entry
+func (b *Backend) LoaderEntryExpect(le mig.LoaderEntry, eval string) error {
+	if err := b.fail("LoaderEntryExpect"); err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	i, err := b.loaderIndex(le.ID)
+	if err != nil {
+		return err
+	}
+	b.loaders[i].ExpectEnv = eval
+	return nil
+}
+
+// Enroll simulates an agent enrolling using the named loader entry, recording the
+// agent against the entry the same way the API does when a loader is used
+func (b *Backend) Enroll(loaderName string, agt mig.Agent) error {
+	b.Lock()
+	defer b.Unlock()
+	for i := range b.loaders {
+		if b.loaders[i].Name != loaderName {
+			continue
+		}
+		if !b.loaders[i].Enabled {
+			return apiError(401, "loader entry is disabled")
+		}
+		now := time.Now().UTC()
+		b.loaders[i].AgentName = agt.Name
+		b.loaders[i].LastSeen = now
+		agt.LoaderName = loaderName
+		if agt.HeartBeatTS.IsZero() {
+			agt.HeartBeatTS = now
+		}
+		if agt.Status == "" {
+			agt.Status = mig.AgtStatusOnline
+		}
+		// Most recent agents are returned first
+		b.agents = append([]mig.Agent{agt}, b.agents...)
+		return nil
+	}
+	return apiError(404, fmt.Sprintf("loader entry %v not found", loaderName))
+}
+
+// Loaders returns a copy of the stored loader entries ordered by ID
+func (b *Backend) Loaders() []mig.LoaderEntry {
+	b.Lock()
+	defer b.Unlock()
+	ret := make([]mig.LoaderEntry, len(b.loaders))
+	copy(ret, b.loaders)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
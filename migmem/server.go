@@ -0,0 +1,215 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package migmem
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jvehent/cljs"
+	"github.com/mozilla/mig"
+	migdbsearch "github.com/mozilla/mig/database/search"
+)
+
+// Server is an http.Handler that serves the loader related parts of the MIG API
+// from a Backend, speaking the same Collection+JSON dialect as the real API. It can
+// be used with httptest to exercise code using the MIG client. The handler does not
+// care where the API is rooted; requests are routed on the last element of the path.
+type Server struct {
+	Backend *Backend
+	APIKey  string // If set, requests must include this key in X-MIGAPIKEY
+}
+
+// NewServer returns a Server for backend b
+func NewServer(b *Backend, apikey string) *Server {
+	return &Server{Backend: b, APIKey: apikey}
+}
+
+func (s *Server) respond(rw http.ResponseWriter, req *http.Request, code int, res *cljs.Resource) {
+	buf, err := res.Marshal()
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	rw.Write(buf)
+}
+
+// Respond with an error; errors from the backend carry the status the API would use
+func (s *Server) respondError(rw http.ResponseWriter, req *http.Request, err error) {
+	code := 500
+	msg := err.Error()
+	if e, ok := err.(*Error); ok {
+		code = e.Status
+		msg = e.Message
+	}
+	res := cljs.New(req.URL.String())
+	res.SetError(cljs.Error{Code: "0", Message: msg})
+	s.respond(rw, req, code, res)
+}
+
+// Respond with a single loader entry
+func (s *Server) respondLoader(rw http.ResponseWriter, req *http.Request, code int, le mig.LoaderEntry) {
+	res := cljs.New(req.URL.String())
+	res.AddItem(cljs.Item{
+		Href: fmt.Sprintf("%v?loaderid=%.0f", req.URL.Path, le.ID),
+		Data: []cljs.Data{{Name: "loader", Value: le}},
+	})
+	s.respond(rw, req, code, res)
+}
+
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if s.APIKey != "" && req.Header.Get("X-MIGAPIKEY") != s.APIKey {
+		s.respondError(rw, req, apiError(401, "authorization verification failed"))
+		return
+	}
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	switch {
+	case strings.HasSuffix(path, "/search") && req.Method == "GET":
+		s.handleSearch(rw, req)
+	case strings.HasSuffix(path, "/loader/new") && req.Method == "POST":
+		s.handleNewLoader(rw, req)
+	case strings.HasSuffix(path, "/loader/status") && req.Method == "POST":
+		s.handleLoaderStatus(rw, req)
+	case strings.HasSuffix(path, "/loader/key") && req.Method == "POST":
+		s.handleLoaderKey(rw, req)
+	case strings.HasSuffix(path, "/loader/expect") && req.Method == "POST":
+		s.handleLoaderExpect(rw, req)
+	default:
+		s.respondError(rw, req, apiError(404, fmt.Sprintf("no handler for %v %v", req.Method, req.URL.Path)))
+	}
+}
+
+// Convert the query string of a search request into search parameters; only the
+// parameters the backend supports are read
+func searchParameters(q url.Values) (p migdbsearch.Parameters, err error) {
+	p = migdbsearch.NewParameters()
+	p.Type = q.Get("type")
+	if v := q.Get("loadername"); v != "" {
+		p.LoaderName = v
+	}
+	if v := q.Get("loaderid"); v != "" {
+		p.LoaderID = v
+	}
+	if v := q.Get("agentname"); v != "" {
+		p.AgentName = v
+	}
+	if v := q.Get("limit"); v != "" {
+		p.Limit, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		p.Offset, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *Server) handleSearch(rw http.ResponseWriter, req *http.Request) {
+	p, err := searchParameters(req.URL.Query())
+	if err != nil {
+		s.respondError(rw, req, apiError(400, err.Error()))
+		return
+	}
+	vals, err := s.Backend.Search(p, p.Type)
+	if err != nil {
+		s.respondError(rw, req, err)
+		return
+	}
+	res := cljs.New(req.URL.String())
+	for _, v := range vals {
+		res.AddItem(cljs.Item{
+			Href: req.URL.String(),
+			Data: []cljs.Data{{Name: p.Type, Value: v}},
+		})
+	}
+	s.respond(rw, req, 200, res)
+}
+
+// Return the loader entry referred to by the loaderid form value; only the ID is set
+func formLoader(req *http.Request) (le mig.LoaderEntry, err error) {
+	le.ID, err = strconv.ParseFloat(req.FormValue("loaderid"), 64)
+	if err != nil {
+		return le, apiError(400, "invalid loader id")
+	}
+	return
+}
+
+func (s *Server) handleNewLoader(rw http.ResponseWriter, req *http.Request) {
+	var le mig.LoaderEntry
+	err := json.Unmarshal([]byte(req.FormValue("loader")), &le)
+	if err != nil {
+		s.respondError(rw, req, apiError(400, err.Error()))
+		return
+	}
+	newle, err := s.Backend.PostNewLoader(le)
+	if err != nil {
+		s.respondError(rw, req, err)
+		return
+	}
+	s.respondLoader(rw, req, 201, newle)
+}
+
+func (s *Server) handleLoaderStatus(rw http.ResponseWriter, req *http.Request) {
+	le, err := formLoader(req)
+	if err != nil {
+		s.respondError(rw, req, err)
+		return
+	}
+	var status bool
+	switch req.FormValue("status") {
+	case "enabled":
+		status = true
+	case "disabled":
+		status = false
+	default:
+		s.respondError(rw, req, apiError(400, "invalid status"))
+		return
+	}
+	err = s.Backend.LoaderEntryStatus(le, status)
+	if err != nil {
+		s.respondError(rw, req, err)
+		return
+	}
+	s.respond(rw, req, 200, cljs.New(req.URL.String()))
+}
+
+func (s *Server) handleLoaderKey(rw http.ResponseWriter, req *http.Request) {
+	le, err := formLoader(req)
+	if err != nil {
+		s.respondError(rw, req, err)
+		return
+	}
+	newle, err := s.Backend.LoaderEntryKey(le)
+	if err != nil {
+		s.respondError(rw, req, err)
+		return
+	}
+	s.respondLoader(rw, req, 200, newle)
+}
+
+func (s *Server) handleLoaderExpect(rw http.ResponseWriter, req *http.Request) {
+	le, err := formLoader(req)
+	if err != nil {
+		s.respondError(rw, req, err)
+		return
+	}
+	err = s.Backend.LoaderEntryExpect(le, req.FormValue("expectenv"))
+	if err != nil {
+		s.respondError(rw, req, err)
+		return
+	}
+	s.respond(rw, req, 200, cljs.New(req.URL.String()))
+}
@@ -0,0 +1,311 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// The result of disabling a single loader entry during offboarding
+type offboardLoader struct {
+	ID         float64 `json:"id"`
+	Name       string  `json:"name"`
+	Slot       int     `json:"slot"`
+	WasEnabled bool    `json:"wasenabled"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// The result of offboarding a single user
+type offboardResult struct {
+	User    string           `json:"user"`
+	Loaders []offboardLoader `json:"loaders"`
+	Tokens  []string         `json:"tokens"` // IDs of the access tokens revoked
+	Error   string           `json:"error,omitempty"`
+}
+
+// Returns true if all of the user's loaders were disabled and tokens revoked
+func (o *offboardResult) ok() bool {
+	if o.Error != "" {
+		return false
+	}
+	for _, x := range o.Loaders {
+		if x.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Report returned for an offboarding request
+type offboardReport struct {
+	Results []offboardResult `json:"results"`
+	Success bool             `json:"success"`
+}
+
+// Payload submitted for an offboarding request
+type offboardRequest struct {
+	Users []string `json:"users"`
+}
+
+// Revoke the access tokens held by user, recording the IDs of the tokens revoked
+// in ret and an audit event for each using ev as the template
+func offboardTokens(user string, ev auditEvent, ret *offboardResult) error {
+	toks, err := revokeUserTokens(user)
+	if err != nil {
+		ev.Action = auditTokenRevoke
+		ev.Timestamp = time.Now().UTC()
+		ev.Owner = user
+		auditor.failure(ev, err)
+		return err
+	}
+	for _, x := range toks {
+		tev := ev
+		tev.Action = auditTokenRevoke
+		tev.Timestamp = time.Now().UTC()
+		tev.Owner = user
+		tev.TokenID = x.ID
+		auditor.success(tev)
+		ret.Tokens = append(ret.Tokens, x.ID)
+	}
+	return nil
+}
+
+// Disable all loader entries belonging to user and revoke the user's access tokens;
+// ev is used as the template for the audit events recorded for each. Addresses are
+// compared without regard to case, so entries created under any capitalization of
+// the address are included, along with the tokens held under the same address.
+// Each entry is disabled holding the lock for its owner's key operations.
+func offboardUser(cli migClient, user string, ev auditEvent) (ret offboardResult) {
+	ret.User = user
+	ret.Loaders = make([]offboardLoader, 0)
+	ret.Tokens = make([]string, 0)
+	rdetails := requestDetails{remoteUser: user}
+	err := rdetails.validate()
+	if err != nil {
+		ret.Error = err.Error()
+		return
+	}
+	// Tokens are revoked first, so they can't be used to issue new keys while the
+	// entries are disabled
+	var tokenErr error
+	revoked := map[string]bool{user: true}
+	if err = offboardTokens(user, ev, &ret); err != nil {
+		tokenErr = err
+	}
+	ldrs, err := searchLoaders(cli, rdetails.searchUserString())
+	if err != nil {
+		ret.Error = err.Error()
+		return
+	}
+	for _, le := range ldrs {
+		owner, _, err := parseLoaderName(le.Name)
+		if err != nil || !strings.EqualFold(owner, user) {
+			continue
+		}
+		rdetails.loaders = append(rdetails.loaders, le)
+		if !revoked[owner] {
+			revoked[owner] = true
+			if err = offboardTokens(owner, ev, &ret); err != nil {
+				tokenErr = err
+			}
+		}
+	}
+	if tokenErr != nil {
+		ret.Error = fmt.Sprintf("unable to revoke tokens: %v", tokenErr)
+	}
+	if len(rdetails.loaders) == 0 {
+		if ret.Error == "" && len(ret.Tokens) == 0 {
+			ret.Error = "no loaders or tokens found for user"
+		}
+		return
+	}
+	for _, le := range rdetails.loaders {
+		ol := offboardLoader{ID: le.ID, Name: le.Name, WasEnabled: le.Enabled}
+		_, ol.Slot, _ = parseLoaderName(le.Name)
+		if le.Enabled {
+			lev := ev
+			lev.Timestamp = time.Now().UTC()
+			lev.setLoader(le)
+			owner, _, _ := parseLoaderName(le.Name)
+			var release func()
+			release, err = lockUserKeys(owner)
+			if err == nil {
+				err = cli.LoaderEntryStatus(le, false)
+				release()
+			}
+			if err != nil {
+				ol.Error = err.Error()
+				auditor.failure(lev, err)
+			} else {
+				auditor.success(lev)
+			}
+		}
+		ret.Loaders = append(ret.Loaders, ol)
+	}
+	return
+}
+
+// Offboard each user in users, returning a report of the results
+func offboardUsers(cli migClient, users []string, ev auditEvent) (ret offboardReport) {
+	ret.Success = true
+	ret.Results = make([]offboardResult, 0)
+	for _, u := range users {
+		res := offboardUser(cli, u, ev)
+		if !res.ok() {
+			ret.Success = false
+		}
+		ret.Results = append(ret.Results, res)
+	}
+	return
+}
+
+// Read a list of users from a file containing one user per line; blank lines and
+// lines starting with # are ignored
+func readUserList(path string) (ret []string, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ret = append(ret, line)
+	}
+	err = scanner.Err()
+	return
+}
+
+func handleAdminOffboard(rw http.ResponseWriter, req *http.Request) {
+	var obr offboardRequest
+
+	rdetails, err := newRequestDetails(req)
+	if err != nil {
+		writeError(rw, req, errUnauthorized("no valid identity for request", err))
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	defer req.Body.Close()
+	err = decoder.Decode(&obr)
+	if err != nil {
+		writeError(rw, req, errBadRequest("invalid request", err))
+		return
+	}
+	if len(obr.Users) == 0 {
+		writeError(rw, req, errBadRequest("no users specified", nil))
+		return
+	}
+	ctx, cancel := keyOpContext(req)
+	defer cancel()
+	cli, err := newMIGClient(ctx)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	ev := newAuditEvent(req, rdetails.remoteUser, auditDisable)
+	ev.Reason = "offboard"
+	resp := offboardUsers(cli, obr.Users, ev)
+	buf, err := json.Marshal(&resp)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(rw, string(buf))
+}
+
+// Entry point for the offboard subcommand, which disables the loader entries of
+// one or more users and writes a JSON report to stdout
+func runOffboard(args []string) int {
+	var (
+		confpath string
+		ufile    string
+		users    []string
+	)
+
+	fs := flag.NewFlagSet("offboard", flag.ExitOnError)
+	fs.StringVar(&confpath, "c", "./mig-selfservice.yml", "path to configuration file")
+	fs.StringVar(&ufile, "file", "", "file containing users to offboard, one per line")
+	fs.Var((*stringList)(&users), "user", "user to offboard, can be specified more than once")
+	fs.Parse(args)
+
+	err := loadConfig(confpath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if ufile != "" {
+		fu, err := readUserList(ufile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		users = append(users, fu...)
+	}
+	if len(users) == 0 {
+		fmt.Fprintf(os.Stderr, "error: no users specified, use -user or -file\n")
+		return 1
+	}
+	// The state store holds the locks shared with the portal, so entries are not
+	// changed while a key operation for the user is in progress
+	err = stateInit(cfg.State)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	// The report is written to stdout, so send any stdout audit events elsewhere
+	auditStdout = os.Stderr
+	err = auditor.init(cfg.Audit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	cli, err := newMIGClient(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	ev := newSystemAuditEvent(auditDisable)
+	ev.Reason = "offboard"
+	if u, err := user.Current(); err == nil {
+		ev.RemoteUser = "cli:" + u.Username
+	}
+	report := offboardUsers(cli, users, ev)
+	buf, err := json.MarshalIndent(&report, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(buf))
+	if !report.Success {
+		return 1
+	}
+	return 0
+}
+
+// A flag.Value that collects each use of a flag into a slice
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
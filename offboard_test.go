@@ -0,0 +1,164 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mozilla/mig"
+)
+
+func TestOffboardUser(t *testing.T) {
+	b := useMemoryBackend(t)
+	for _, n := range []string{
+		"migss-user@x.com-1",
+		"migss-User@X.com-2",
+		"migss-USER@x.com-3",
+		"migss-user@x.com-1-1",
+		"migss-other@x.com-1",
+	} {
+		le, err := b.PostNewLoader(mig.LoaderEntry{Name: n})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = b.LoaderEntryStatus(le, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cli, err := newMIGClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := offboardUser(cli, "User@x.com", newSystemAuditEvent(auditDisable))
+	if !res.ok() || len(res.Loaders) != 3 {
+		t.Fatalf("offboard: got %+v", res)
+	}
+	for _, le := range b.Loaders() {
+		want := le.Name == "migss-user@x.com-1-1" || le.Name == "migss-other@x.com-1"
+		if le.Enabled != want {
+			t.Errorf("loader %v enabled %v after offboarding", le.Name, le.Enabled)
+		}
+	}
+
+	// A user with no loaders is reported, since the address may be wrong
+	res = offboardUser(cli, "nobody@x.com", newSystemAuditEvent(auditDisable))
+	if res.ok() || res.Error == "" {
+		t.Fatalf("offboard of user with no loaders: got %+v", res)
+	}
+}
+
+// Offboarding waits for a key operation in progress for the user
+func TestOffboardWaitsForOwner(t *testing.T) {
+	b := useMemoryBackend(t)
+	useMemoryStore(t)
+	le, err := b.PostNewLoader(mig.LoaderEntry{Name: "migss-user@x.com-1"})
+	if err == nil {
+		err = b.LoaderEntryStatus(le, true)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := newMIGClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := lockUserKeys("user@x.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan offboardResult)
+	go func() {
+		done <- offboardUser(cli, "user@x.com", newSystemAuditEvent(auditDisable))
+	}()
+	select {
+	case res := <-done:
+		t.Fatalf("offboard completed during the user's key operation: %+v", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !b.Loaders()[0].Enabled {
+		t.Fatal("entry disabled during the user's key operation")
+	}
+	release()
+	if res := <-done; !res.ok() || b.Loaders()[0].Enabled {
+		t.Fatalf("offboard: got %+v", res)
+	}
+}
+
+// Offboarding revokes the user's access tokens, including those held under another
+// capitalization of the address that owns loaders
+func TestOffboardTokens(t *testing.T) {
+	b := useMemoryBackend(t)
+	useMemoryStore(t)
+	useTokens(t, true)
+	m := useMemoryAudit(t)
+	le, err := b.PostNewLoader(mig.LoaderEntry{Name: "migss-User@x.com-1"})
+	if err == nil {
+		err = b.LoaderEntryStatus(le, true)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, tok, err := createToken("user@x.com", "ci", []string{scopeStatus}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token2, tok2, err := createToken("User@x.com", "ci", []string{scopeStatus}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := createToken("other@x.com", "ci", []string{scopeStatus}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/keystatus", setTokenContext(scopeStatus, handleKeyStatus)).Methods("GET")
+	keystatus := func(token string) int {
+		return serveAs(t, r, "", "GET", "/keystatus", "", "Authorization", "Bearer "+token).Code
+	}
+	if c := keystatus(token); c != 200 {
+		t.Fatalf("keystatus with token before offboarding: got %v", c)
+	}
+
+	cli, err := newMIGClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.events = nil
+	res := offboardUser(cli, "user@x.com", newSystemAuditEvent(auditDisable))
+	if !res.ok() || len(res.Loaders) != 1 || len(res.Tokens) != 2 {
+		t.Fatalf("offboard: got %+v", res)
+	}
+	for _, x := range []string{token, token2} {
+		if c := keystatus(x); c != 401 {
+			t.Errorf("keystatus with token after offboarding: got %v", c)
+		}
+	}
+	if c := keystatus(other); c != 200 {
+		t.Errorf("keystatus with another user's token: got %v", c)
+	}
+	revoked := make(map[string]bool)
+	for _, ev := range m.events {
+		if ev.Action == auditTokenRevoke && ev.Outcome == auditSuccess {
+			revoked[ev.TokenID] = true
+		}
+	}
+	if len(revoked) != 2 || !revoked[tok.ID] || !revoked[tok2.ID] {
+		t.Fatalf("token revocations not audited: %+v", m.events)
+	}
+
+	// A user holding only tokens is offboarded without error
+	if _, _, err = createToken("tokenonly@x.com", "ci", []string{scopeStatus}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	res = offboardUser(cli, "tokenonly@x.com", newSystemAuditEvent(auditDisable))
+	if !res.ok() || len(res.Tokens) != 1 {
+		t.Fatalf("offboard of user with only tokens: got %+v", res)
+	}
+}
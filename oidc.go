@@ -0,0 +1,359 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Configuration for OpenID Connect authentication; if Issuer is set the portal
+// authenticates users itself using the authorization code flow, rather than
+// relying on a REMOTE_USER header set by a fronting proxy. Users are identified by
+// their email address, so Claim must name a claim whose value is an email address,
+// such as upn where the provider sets it to the user's address.
+type oidcConfig struct {
+	Issuer          string        // Issuer URL of the OpenID provider
+	ClientID        string        // Client ID registered with the provider
+	ClientSecret    string        // Client secret registered with the provider
+	RedirectURL     string        // Callback URL, should end in /oidc/callback
+	Claim           string        // ID token claim holding the user's email address, default email
+	Scopes          []string      // Additional scopes to request
+	SessionKey      string        // Key used to sign session cookies
+	SessionLifetime time.Duration // Lifetime of a session, default 8h
+}
+
+const (
+	oidcSessionCookie  = "migss-session"
+	oidcStateCookie    = "migss-oidc-state"
+	oidcStateLifetime  = 10 * time.Minute
+	oidcClockSkew      = time.Minute
+	oidcDefaultClaim   = "email"
+	oidcDefaultSession = 8 * time.Hour
+)
+
+// Purposes of the values signed with the session key, so the value of one cookie
+// can't be presented as the other
+const (
+	oidcStatePurpose   = "oidc-state"
+	oidcSessionPurpose = "session"
+)
+
+type oidcProvider struct {
+	conf       oidcConfig
+	hc         *http.Client
+	sessionKey []byte
+
+	issuer   string
+	authURL  string
+	tokenURL string
+	jwksURL  string
+
+	sync.Mutex
+	keys map[string]*rsa.PublicKey
+}
+
+var oidcProv *oidcProvider
+
+// Create a new provider from the configuration, performing discovery against the
+// issuer using hc
+func newOIDCProvider(conf oidcConfig, hc *http.Client) (ret *oidcProvider, err error) {
+	ret = &oidcProvider{conf: conf, hc: hc}
+	if ret.conf.Claim == "" {
+		ret.conf.Claim = oidcDefaultClaim
+	}
+	if ret.conf.SessionLifetime == 0 {
+		ret.conf.SessionLifetime = oidcDefaultSession
+	}
+	if ret.conf.ClientID == "" || ret.conf.RedirectURL == "" {
+		return nil, fmt.Errorf("oidc configuration requires clientid and redirecturl")
+	}
+	if ret.conf.SessionKey != "" {
+		ret.sessionKey = []byte(ret.conf.SessionKey)
+	} else {
+		// Without a configured key sessions will not survive a restart, and will
+		// not be valid across multiple instances of the portal
+		log.Printf("oidc sessionkey not set, using a random session key")
+		k, err := randomString(32)
+		if err != nil {
+			return nil, err
+		}
+		ret.sessionKey = []byte(k)
+	}
+	err = ret.discover()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Fetch the provider metadata from the discovery endpoint
+func (o *oidcProvider) discover() error {
+	var disc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	u := strings.TrimSuffix(o.conf.Issuer, "/") + "/.well-known/openid-configuration"
+	err := o.getJSON(u, &disc)
+	if err != nil {
+		return fmt.Errorf("oidc discovery failed: %v", err)
+	}
+	if disc.Issuer != o.conf.Issuer {
+		return fmt.Errorf("oidc discovery returned issuer %q, expected %q",
+			disc.Issuer, o.conf.Issuer)
+	}
+	if disc.AuthorizationEndpoint == "" || disc.TokenEndpoint == "" || disc.JWKSURI == "" {
+		return fmt.Errorf("oidc discovery document is incomplete")
+	}
+	o.issuer = disc.Issuer
+	o.authURL = disc.AuthorizationEndpoint
+	o.tokenURL = disc.TokenEndpoint
+	o.jwksURL = disc.JWKSURI
+	return o.fetchKeys()
+}
+
+func (o *oidcProvider) getJSON(u string, v interface{}) error {
+	resp, err := o.hc.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v returned %v", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Refresh the signing keys from the provider's key set
+func (o *oidcProvider) fetchKeys() error {
+	var set jwkSet
+	err := o.getJSON(o.jwksURL, &set)
+	if err != nil {
+		return err
+	}
+	keys, err := set.rsaKeys()
+	if err != nil {
+		return err
+	}
+	o.Lock()
+	o.keys = keys
+	o.Unlock()
+	return nil
+}
+
+// Locate the key for a token; if the key ID is unknown the key set is fetched
+// again, since the provider may have rotated keys
+func (o *oidcProvider) tokenKey(hdr jwtHeader) (interface{}, error) {
+	o.Lock()
+	k, ok := o.keys[hdr.Kid]
+	o.Unlock()
+	if ok {
+		return k, nil
+	}
+	err := o.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	o.Lock()
+	defer o.Unlock()
+	k, ok = o.keys[hdr.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", hdr.Kid)
+	}
+	return k, nil
+}
+
+// Validate an ID token and return the user identified by the configured claim
+func (o *oidcProvider) validateIDToken(token string, nonce string) (string, error) {
+	_, claims, err := parseJWT(token, o.tokenKey)
+	if err != nil {
+		return "", err
+	}
+	if claims.str("iss") != o.issuer {
+		return "", fmt.Errorf("id token has invalid issuer")
+	}
+	if !claims.hasAudience(o.conf.ClientID) {
+		return "", fmt.Errorf("id token has invalid audience")
+	}
+	if azp := claims.str("azp"); azp != "" && azp != o.conf.ClientID {
+		return "", fmt.Errorf("id token has invalid authorized party")
+	}
+	err = claims.validateTimes(oidcClockSkew)
+	if err != nil {
+		return "", err
+	}
+	if claims.str("nonce") != nonce {
+		return "", fmt.Errorf("id token has invalid nonce")
+	}
+	if o.conf.Claim == "email" {
+		if v, ok := claims["email_verified"].(bool); ok && !v {
+			return "", fmt.Errorf("email address has not been verified")
+		}
+	}
+	ret := claims.str(o.conf.Claim)
+	if ret == "" {
+		return "", fmt.Errorf("id token does not contain claim %v", o.conf.Claim)
+	}
+	if validUser(ret) != nil {
+		return "", fmt.Errorf("id token claim %v is not an email address", o.conf.Claim)
+	}
+	return ret, nil
+}
+
+// Exchange an authorization code for an ID token
+func (o *oidcProvider) exchange(code string) (string, error) {
+	var tokresp struct {
+		IDToken string `json:"id_token"`
+	}
+	data := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.conf.RedirectURL},
+	}
+	r, err := http.NewRequest("POST", o.tokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(url.QueryEscape(o.conf.ClientID), url.QueryEscape(o.conf.ClientSecret))
+	resp, err := o.hc.Do(r)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request returned %v", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokresp)
+	if err != nil {
+		return "", err
+	}
+	if tokresp.IDToken == "" {
+		return "", fmt.Errorf("token response did not include an id token")
+	}
+	return tokresp.IDToken, nil
+}
+
+func (o *oidcProvider) secureCookies() bool {
+	return strings.HasPrefix(o.conf.RedirectURL, "https://")
+}
+
+func (o *oidcProvider) setCookie(rw http.ResponseWriter, name string, value string, expires time.Time) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   o.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (o *oidcProvider) clearCookie(rw http.ResponseWriter, name string) {
+	o.setCookie(rw, name, "", time.Unix(0, 0))
+}
+
+// Return the user associated with the session cookie in the request
+func (o *oidcProvider) sessionUser(req *http.Request) (string, error) {
+	c, err := req.Cookie(oidcSessionCookie)
+	if err != nil {
+		return "", err
+	}
+	return verifyValue(o.sessionKey, oidcSessionPurpose, c.Value)
+}
+
+// Respond to a request that has no valid session; page loads are sent to the
+// login handler, anything else gets an error
+func (o *oidcProvider) unauthenticated(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" && req.URL.Path == "/" {
+		http.Redirect(rw, req, "/login", http.StatusFound)
+		return
+	}
+	writeError(rw, req, errUnauthorized("authentication required", nil))
+}
+
+func (o *oidcProvider) handleLogin(rw http.ResponseWriter, req *http.Request) {
+	state, err := randomString(24)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	nonce, err := randomString(24)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	exp := time.Now().Add(oidcStateLifetime)
+	o.setCookie(rw, oidcStateCookie, signValue(o.sessionKey, oidcStatePurpose, state+"|"+nonce, exp), exp)
+	scopes := append([]string{"openid", "email", "profile"}, o.conf.Scopes...)
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.conf.ClientID},
+		"redirect_uri":  {o.conf.RedirectURL},
+		"scope":         {strings.Join(scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(o.authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(rw, req, o.authURL+sep+q.Encode(), http.StatusFound)
+}
+
+func (o *oidcProvider) handleCallback(rw http.ResponseWriter, req *http.Request) {
+	c, err := req.Cookie(oidcStateCookie)
+	if err != nil {
+		writeError(rw, req, errBadRequest("login state not found", err))
+		return
+	}
+	o.clearCookie(rw, oidcStateCookie)
+	sv, err := verifyValue(o.sessionKey, oidcStatePurpose, c.Value)
+	if err != nil {
+		writeError(rw, req, errBadRequest("invalid login state", err))
+		return
+	}
+	args := strings.SplitN(sv, "|", 2)
+	if len(args) != 2 || req.FormValue("state") != args[0] {
+		writeError(rw, req, errBadRequest("invalid login state", nil))
+		return
+	}
+	if e := req.FormValue("error"); e != "" {
+		writeError(rw, req, errUnauthorized("login failed", fmt.Errorf("identity provider returned %v", e)))
+		return
+	}
+	idtoken, err := o.exchange(req.FormValue("code"))
+	if err != nil {
+		writeError(rw, req, errUnauthorized("login failed", fmt.Errorf("oidc code exchange failed: %v", err)))
+		return
+	}
+	user, err := o.validateIDToken(idtoken, args[1])
+	if err != nil {
+		auditor.failure(newAuditEvent(req, "", auditAuthFailure), err)
+		writeError(rw, req, errUnauthorized("login failed", fmt.Errorf("oidc id token rejected: %v", err)))
+		return
+	}
+	exp := time.Now().Add(o.conf.SessionLifetime)
+	o.setCookie(rw, oidcSessionCookie, signValue(o.sessionKey, oidcSessionPurpose, user, exp), exp)
+	http.Redirect(rw, req, "/", http.StatusFound)
+}
+
+// Logging out changes state, so the handler only accepts POST requests protected
+// with csrfProtect; otherwise any page could log the user out with a link
+func (o *oidcProvider) handleLogout(rw http.ResponseWriter, req *http.Request) {
+	o.clearCookie(rw, oidcSessionCookie)
+	fmt.Fprint(rw, "logged out\n")
+}
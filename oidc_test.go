@@ -0,0 +1,293 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// A minimal OpenID provider, issuing an ID token for user for any authorization code
+type mockIdP struct {
+	srv  *httptest.Server
+	key  *rsa.PrivateKey
+	user string
+
+	sync.Mutex
+	nonce  string                 // Nonce to include in the next ID token
+	claims map[string]interface{} // Additional claims to include in ID tokens
+}
+
+func newMockIdP(t *testing.T, user string) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIdP{key: key, user: user}
+	mx := http.NewServeMux()
+	mx.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]string{
+			"issuer":                 m.srv.URL,
+			"authorization_endpoint": m.srv.URL + "/authorize",
+			"token_endpoint":         m.srv.URL + "/token",
+			"jwks_uri":               m.srv.URL + "/jwks",
+		})
+	})
+	mx.HandleFunc("/jwks", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mx.HandleFunc("/token", func(rw http.ResponseWriter, req *http.Request) {
+		id, secret, ok := req.BasicAuth()
+		if !ok || id != "portal" || secret != "secret" || req.FormValue("code") != "code1" {
+			http.Error(rw, "invalid client or code", http.StatusBadRequest)
+			return
+		}
+		m.Lock()
+		nonce := m.nonce
+		m.Unlock()
+		json.NewEncoder(rw).Encode(map[string]string{"id_token": m.idToken(t, nonce)})
+	})
+	m.srv = httptest.NewServer(mx)
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func (m *mockIdP) idToken(t *testing.T, nonce string) string {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":            m.srv.URL,
+		"aud":            "portal",
+		"sub":            "1234",
+		"email":          m.user,
+		"email_verified": true,
+		"nonce":          nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+	return signJWT(t, m.key, map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"}, claims)
+}
+
+func (m *mockIdP) setNonce(n string) {
+	m.Lock()
+	m.nonce = n
+	m.Unlock()
+}
+
+// Return the value of the named cookie set in the response
+func responseCookie(rw *httptest.ResponseRecorder, name string) string {
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newMockIdP(t, "user@example.com")
+	prov, err := newOIDCProvider(oidcConfig{
+		Issuer:       idp.srv.URL,
+		ClientID:     "portal",
+		ClientSecret: "secret",
+		RedirectURL:  "http://portal.example.com/oidc/callback",
+		SessionKey:   "session-key",
+	}, idp.srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldProv, oldKey := oidcProv, csrfKey
+	oidcProv, csrfKey = prov, []byte("csrf-key")
+	defer func() { oidcProv, csrfKey = oldProv, oldKey }()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/login", prov.handleLogin).Methods("GET")
+	r.HandleFunc("/oidc/callback", prov.handleCallback).Methods("GET")
+	r.HandleFunc("/logout", setContext(csrfProtect(prov.handleLogout))).Methods("POST")
+	r.HandleFunc("/", setContext(func(rw http.ResponseWriter, req *http.Request) {
+		rdetails, err := newRequestDetails(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rw.Write([]byte(rdetails.remoteUser))
+	})).Methods("GET")
+	do := func(method string, path string, hdr http.Header, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rw := httptest.NewRecorder()
+		context.ClearHandler(r).ServeHTTP(rw, req)
+		return rw
+	}
+
+	// Without a session the portal redirects to the login handler
+	rw := do("GET", "/", nil)
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != "/login" {
+		t.Fatalf("unauthenticated request: got %v %v", rw.Code, rw.Header().Get("Location"))
+	}
+
+	rw = do("GET", "/login", nil)
+	if rw.Code != http.StatusFound {
+		t.Fatalf("login: got %v", rw.Code)
+	}
+	authURL, err := url.Parse(rw.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(authURL.String(), idp.srv.URL+"/authorize?") {
+		t.Fatalf("login redirected to %v", rw.Header().Get("Location"))
+	}
+	q := authURL.Query()
+	if q.Get("client_id") != "portal" || q.Get("redirect_uri") != prov.conf.RedirectURL {
+		t.Fatalf("unexpected authorization request %v", authURL)
+	}
+	state := &http.Cookie{Name: oidcStateCookie, Value: responseCookie(rw, oidcStateCookie)}
+	if state.Value == "" {
+		t.Fatal("login did not set a state cookie")
+	}
+
+	// The state cookie is not a session
+	rw = do("GET", "/", nil, &http.Cookie{Name: oidcSessionCookie, Value: state.Value})
+	if rw.Code != http.StatusFound {
+		t.Fatalf("state cookie accepted as a session: got %v", rw.Code)
+	}
+
+	// A mismatched state or nonce is rejected
+	idp.setNonce(q.Get("nonce"))
+	rw = do("GET", "/oidc/callback?code=code1&state=wrong", nil, state)
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("callback with wrong state: got %v", rw.Code)
+	}
+	idp.setNonce("wrong")
+	rw = do("GET", "/oidc/callback?code=code1&state="+url.QueryEscape(q.Get("state")), nil, state)
+	if rw.Code != http.StatusUnauthorized {
+		t.Fatalf("callback with wrong nonce: got %v", rw.Code)
+	}
+
+	idp.setNonce(q.Get("nonce"))
+	rw = do("GET", "/oidc/callback?code=code1&state="+url.QueryEscape(q.Get("state")), nil, state)
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != "/" {
+		t.Fatalf("callback: got %v %v", rw.Code, rw.Body.String())
+	}
+	session := &http.Cookie{Name: oidcSessionCookie, Value: responseCookie(rw, oidcSessionCookie)}
+	if session.Value == "" {
+		t.Fatal("callback did not set a session cookie")
+	}
+
+	rw = do("GET", "/", nil, session)
+	if rw.Code != http.StatusOK || rw.Body.String() != "user@example.com" {
+		t.Fatalf("request with session: got %v %v", rw.Code, rw.Body.String())
+	}
+
+	// The session cookie is not login state
+	rw = do("GET", "/oidc/callback?code=code1&state=user@example.com", nil,
+		&http.Cookie{Name: oidcStateCookie, Value: session.Value})
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("session cookie accepted as login state: got %v", rw.Code)
+	}
+
+	// Logging out requires a POST with a valid CSRF token
+	rw = do("GET", "/logout", nil, session)
+	if rw.Code != http.StatusNotFound && rw.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /logout: got %v", rw.Code)
+	}
+	origin := http.Header{"Origin": {"http://example.com"}}
+	rw = do("POST", "/logout", origin, session)
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("POST /logout without CSRF token: got %v", rw.Code)
+	}
+	hdr := http.Header{
+		"Origin":       {"http://example.com"},
+		"X-Csrf-Token": {csrfCompute("csrf-session", "user@example.com")},
+	}
+	rw = do("POST", "/logout", hdr, session, &http.Cookie{Name: csrfCookie, Value: "csrf-session"})
+	if rw.Code != http.StatusOK {
+		t.Fatalf("POST /logout: got %v %v", rw.Code, rw.Body.String())
+	}
+	var cleared bool
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == oidcSessionCookie && c.Value == "" {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Fatal("logout did not clear the session cookie")
+	}
+}
+
+// A claim other than email identifies the user only if it holds an email address
+func TestOIDCClaim(t *testing.T) {
+	idp := newMockIdP(t, "user@example.com")
+	idp.claims = map[string]interface{}{"upn": "upn.user@example.com", "preferred_username": "user"}
+	tests := []struct {
+		claim string
+		want  string // Empty if the token must be rejected
+	}{
+		{"", "user@example.com"},
+		{"upn", "upn.user@example.com"},
+		{"preferred_username", ""},
+		{"sub", ""},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		prov, err := newOIDCProvider(oidcConfig{
+			Issuer:      idp.srv.URL,
+			ClientID:    "portal",
+			RedirectURL: "http://portal.example.com/oidc/callback",
+			Claim:       tt.claim,
+		}, idp.srv.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := prov.validateIDToken(idp.idToken(t, "n1"), "n1")
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("claim %q: got %q, %v, want %q", tt.claim, got, err, tt.want)
+		}
+	}
+}
+
+func TestSignValuePurpose(t *testing.T) {
+	key := []byte("key")
+	sv := signValue(key, "a", "value", time.Now().Add(time.Minute))
+	v, err := verifyValue(key, "a", sv)
+	if err != nil || v != "value" {
+		t.Fatalf("verifyValue: got %q, %v", v, err)
+	}
+	if _, err = verifyValue(key, "b", sv); err == nil {
+		t.Fatal("value verified for a different purpose")
+	}
+	if _, err = verifyValue([]byte("other"), "a", sv); err == nil {
+		t.Fatal("value verified with a different key")
+	}
+	sv = signValue(key, "a", "value", time.Now().Add(-time.Minute))
+	if _, err = verifyValue(key, "a", sv); err == nil {
+		t.Fatal("expired value verified")
+	}
+}
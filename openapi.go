@@ -0,0 +1,223 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The OpenAPI document for the API is generated from apiRoutes and the request and
+// response types of each route
+
+const openAPIVersion = "3.0.3"
+
+// Names the OpenAPI schema for each Go type in the API
+var openAPINames = map[reflect.Type]string{
+	reflect.TypeOf(apiAgent{}):      "Agent",
+	reflect.TypeOf(apiSlot{}):       "Slot",
+	reflect.TypeOf(apiSlotList{}):   "SlotList",
+	reflect.TypeOf(apiKeyRequest{}): "KeyRequest",
+	reflect.TypeOf(apiKeyIssued{}):  "KeyIssued",
+	reflect.TypeOf(apiMe{}):         "Me",
+	reflect.TypeOf(errorReply{}):    "Error",
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+type openAPISchemas map[string]interface{}
+
+// Return the schema for t, adding schemas for any named struct types it uses to
+// schemas and referring to them
+func (o openAPISchemas) schema(t reflect.Type) (map[string]interface{}, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}, nil
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}, nil
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}, nil
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}, nil
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}, nil
+	case t.Kind() == reflect.Slice:
+		items, err := o.schema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "array", "items": items}, nil
+	case t.Kind() == reflect.Struct:
+		name, ok := openAPINames[t]
+		if !ok {
+			return nil, fmt.Errorf("no OpenAPI schema name for %v", t)
+		}
+		if _, ok := o[name]; !ok {
+			// Add a placeholder first in case the type refers to itself
+			o[name] = nil
+			obj, err := o.object(t)
+			if err != nil {
+				return nil, err
+			}
+			o[name] = obj
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}, nil
+	}
+	return nil, fmt.Errorf("no OpenAPI schema for %v", t)
+}
+
+// Return the schema for the struct type t, using the json tag of each field for its
+// name and the doc tag for its description
+func (o openAPISchemas) object(t reflect.Type) (map[string]interface{}, error) {
+	props := make(map[string]interface{})
+	required := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" || f.PkgPath != "" {
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = f.Name
+		}
+		s, err := o.schema(f.Type)
+		if err != nil {
+			return nil, fmt.Errorf("field %v of %v: %v", f.Name, t, err)
+		}
+		if d := f.Tag.Get("doc"); d != "" {
+			if _, ok := s["$ref"]; ok {
+				// Siblings of $ref are ignored, so wrap the reference
+				s = map[string]interface{}{"allOf": []interface{}{s}}
+			}
+			s["description"] = d
+		}
+		props[name] = s
+		omit := false
+		for _, x := range tag[1:] {
+			if x == "omitempty" {
+				omit = true
+			}
+		}
+		if !omit && f.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+	ret := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		ret["required"] = required
+	}
+	return ret, nil
+}
+
+var pathParam = regexp.MustCompile(`\{([^}]+)\}`)
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// Generate the OpenAPI document describing routes
+func openAPIDocument(routes []apiRoute) (map[string]interface{}, error) {
+	schemas := make(openAPISchemas)
+	errSchema, err := schemas.schema(reflect.TypeOf(errorReply{}))
+	if err != nil {
+		return nil, err
+	}
+	errResp := map[string]interface{}{
+		"description": "The request failed",
+		"content":     jsonContent(errSchema),
+	}
+	paths := make(map[string]interface{})
+	for _, a := range routes {
+		op := map[string]interface{}{
+			"summary":     a.summary,
+			"description": "Access tokens used for this request require the " + a.scope + " scope.",
+		}
+		var params []interface{}
+		for _, m := range pathParam.FindAllStringSubmatch(a.path, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "integer"},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if a.request != nil {
+			rs, err := schemas.schema(reflect.TypeOf(a.request))
+			if err != nil {
+				return nil, fmt.Errorf("request for %v %v: %v", a.method, a.path, err)
+			}
+			op["requestBody"] = map[string]interface{}{
+				"required": false,
+				"content":  jsonContent(rs),
+			}
+		}
+		resp := map[string]interface{}{"description": http.StatusText(a.status)}
+		if a.response != nil {
+			rs, err := schemas.schema(reflect.TypeOf(a.response))
+			if err != nil {
+				return nil, fmt.Errorf("response for %v %v: %v", a.method, a.path, err)
+			}
+			resp["content"] = jsonContent(rs)
+		}
+		op["responses"] = map[string]interface{}{
+			strconv.Itoa(a.status): resp,
+			"default":              errResp,
+		}
+		p, ok := paths[apiPrefix+a.path].(map[string]interface{})
+		if !ok {
+			p = make(map[string]interface{})
+			paths[apiPrefix+a.path] = p
+		}
+		p[strings.ToLower(a.method)] = op
+	}
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":   "MIG self-service portal API",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"accessToken": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"accessToken": []string{}}},
+	}, nil
+}
+
+// The OpenAPI document for apiRoutes, generated when the routes are registered
+var openAPIDoc []byte
+
+// Generate the OpenAPI document for routes, returning it encoded as JSON
+func encodeOpenAPI(routes []apiRoute) ([]byte, error) {
+	doc, err := openAPIDocument(routes)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func handleOpenAPI(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(openAPIDoc)
+}
@@ -0,0 +1,98 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// The document served describes every route in apiRoutes and every API type
+func TestOpenAPIDocument(t *testing.T) {
+	r := mux.NewRouter()
+	if err := addAPIRoutes(r); err != nil {
+		t.Fatal(err)
+	}
+	rw := serveAs(t, r, "user@example.com", "GET", apiPrefix+"/openapi.json", "")
+	var doc struct {
+		Paths map[string]map[string]struct {
+			RequestBody *struct {
+				Content map[string]struct {
+					Schema map[string]interface{} `json:"schema"`
+				} `json:"content"`
+			} `json:"requestBody"`
+			Responses map[string]struct {
+				Content map[string]struct {
+					Schema map[string]interface{} `json:"schema"`
+				} `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if rw.Code != 200 || json.Unmarshal(rw.Body.Bytes(), &doc) != nil {
+		t.Fatalf("openapi.json: got %v %v", rw.Code, rw.Body.String())
+	}
+
+	// Return the name of the schema a reference refers to
+	refName := func(s map[string]interface{}) string {
+		ref, _ := s["$ref"].(string)
+		return strings.TrimPrefix(ref, "#/components/schemas/")
+	}
+	for _, a := range apiRoutes {
+		op, ok := doc.Paths[apiPrefix+a.path][strings.ToLower(a.method)]
+		if !ok {
+			t.Errorf("%v %v is not described", a.method, a.path)
+			continue
+		}
+		if a.request != nil {
+			want := openAPINames[reflect.TypeOf(a.request)]
+			if op.RequestBody == nil || refName(op.RequestBody.Content["application/json"].Schema) != want {
+				t.Errorf("%v %v: request is not described as %v", a.method, a.path, want)
+			}
+		}
+		resp, ok := op.Responses[strconv.Itoa(a.status)]
+		if !ok {
+			t.Errorf("%v %v: status %v is not described", a.method, a.path, a.status)
+		}
+		if a.response != nil {
+			want := openAPINames[reflect.TypeOf(a.response)]
+			if refName(resp.Content["application/json"].Schema) != want {
+				t.Errorf("%v %v: response is not described as %v", a.method, a.path, want)
+			}
+		}
+		if refName(op.Responses["default"].Content["application/json"].Schema) != "Error" {
+			t.Errorf("%v %v: errors are not described", a.method, a.path)
+		}
+	}
+	for typ, name := range openAPINames {
+		if doc.Components.Schemas[name] == nil {
+			t.Errorf("no schema for %v (%v)", name, typ)
+		}
+	}
+}
+
+// A type without a schema name is reported rather than causing a panic
+func TestOpenAPIUnnamedType(t *testing.T) {
+	type unnamed struct {
+		A string `json:"a"`
+	}
+	routes := []apiRoute{{method: "GET", path: "/x", response: unnamed{}, status: 200}}
+	if _, err := encodeOpenAPI(routes); err == nil {
+		t.Fatal("document generated for a type without a schema name")
+	}
+	routes = []apiRoute{{method: "GET", path: "/x", response: apiSlot{}, status: 200},
+		{method: "POST", path: "/y", request: map[string]string{}, status: 200}}
+	if _, err := encodeOpenAPI(routes); err == nil {
+		t.Fatal("document generated for a request type with no schema")
+	}
+}
@@ -13,7 +13,9 @@ import (
 
 var mainTmpl = `<html>
 <head>
+<meta name="csrf-token" content="{{.CSRFToken}}">
 <script src="static/jquery-3.2.1.min.js" type="text/javascript"></script>
+<script src="static/errors.js" type="text/javascript"></script>
 <script src="static/selfservice.js" type="text/javascript"></script>
 <link rel="stylesheet" type="text/css" href="static/selfservice.css">
 </head>
@@ -25,31 +27,65 @@ var mainTmpl = `<html>
 <h1>MIG self-service portal</h1>
 </div>
 <div class="intro">
-  <p>Welcome, <i>{{.RemoteUser}}.</i></p>
+  <p>Welcome, <i>{{.RemoteUser}}.</i>{{if .IsAdmin}} <a href="admin">Administration</a>{{end}}{{if .Logout}} <a id="logout" href="#">Log out</a>{{end}}</p>
   <p>This is the self-service portal for <a href="http://mig.mozilla.org">Mozilla
   Investigator</a>. Here you can download MIG for your workstation devices, and create
-  your own keys to allow you to install the agent. You can create up to 3 keys to use
+  your own keys to allow you to install the agent. You can create up to {{.SlotCount}} keys to use
   on end-point devices that support MIG.</p>
   <p>Mozilla Infosec uses the MIG agent to rapidly respond to incidents and help
   identify security issues that may have occurred within the organization.</p>
-  <p>After generating a key in a key slot, be sure to note the key as it will only be
-  displayed upon initial creation.</p>
+  <p>After generating a key in a key slot, the key can be retrieved once, within a few
+  minutes of being generated. Be sure to note the key when it is shown, as it cannot be
+  displayed again. Instead of displaying the key you can download an installer for your
+  operating system with the key included, which installs MIG when you run the install
+  script it contains.</p>
 </div>
 <div>
   <h2>Generate install keys</h2>
-  <table>
+  <table id="slots" data-slots="{{.SlotCount}}">
     <thead>
       <tr>
-      <td>Device slot</td><td>Assigned key</td><td>Action</td><td>Key last used</td>
+      <td>Device slot</td><td>Assigned key</td><td>Action</td><td>Key last used</td><td>Device</td>
       </tr>
     </thead>
     <tbody>
-      <tr id="slot1"><td>1</td><td>Loading</td><td>Loading</td><td>Loading</td></tr>
-      <tr id="slot2"><td>2</td><td>Loading</td><td>Loading</td><td>Loading</td></tr>
-      <tr id="slot3"><td>3</td><td>Loading</td><td>Loading</td><td>Loading</td></tr>
+      {{range .Slots}}
+      <tr id="slot{{.}}"><td>{{.}}</td><td>Loading</td><td>Loading</td><td>Loading</td><td>Loading</td></tr>
+      {{end}}
+    </tbody>
+  </table>
+</div>
+{{if .TokensEnabled}}
+<div>
+  <h2>Personal access tokens</h2>
+  <p>Personal access tokens let the migss command line client and your own scripts use
+  the portal API on your behalf, for example to enroll a system without a browser. A token
+  with the status scope can view your key slots, and a token with the keys scope can also
+  generate, retrieve and remove keys. The token is shown once, when it is created.</p>
+  <form id="tokenform" autocomplete=off>
+    <p>
+    Name <input type="text" id="tokenname" maxlength="100">
+    Scope <select id="tokenscope">
+      <option value="status">status</option>
+      <option value="keys">keys</option>
+    </select>
+    Expires in <input type="number" id="tokendays" min="1" max="{{.TokenMaxDays}}" value="30" size="4"> days
+    <input type="submit" value="Create token">
+    </p>
+  </form>
+  <p id="newtoken"></p>
+  <table>
+    <thead>
+      <tr>
+      <td>Name</td><td>Scopes</td><td>Created</td><td>Expires</td><td>Last used</td><td>Action</td>
+      </tr>
+    </thead>
+    <tbody id="tokens">
+      <tr><td>Loading</td></tr>
     </tbody>
   </table>
 </div>
+{{end}}
 <div>
   <h2>Download the MIG installer</h2>
   <div>
@@ -89,8 +125,15 @@ var mainTmpl = `<html>
     <li>DEB <a href="{{.DownloadLinuxDEB}}">{{.DownloadLinuxDEB}}</a>
     </p>
     <p>
-    After installing the package, create /etc/mig/mig-loader.key and place your generated
-    key in this file. Following this, schedule /sbin/mig-loader to run periodically as root (for example
+    The simplest way to install MIG on Linux is to download the Linux install script for
+    your new key, and run it as root using <code>sh mig-install-linux.sh</code>. The script
+    installs the package, writes your key to /etc/mig/mig-loader.key and schedules
+    /sbin/mig-loader to run daily.
+    </p>
+    <p>
+    To install MIG by hand, after installing the package, download the key file for your new
+    key and copy it to /etc/mig/mig-loader.key, or create /etc/mig/mig-loader.key and place
+    your generated key in this file. Following this, schedule /sbin/mig-loader to run periodically as root (for example
     once per day), this will fetch the agent and keep it up to date. You can run it once manually
     to initially kick the process off.
     </p>
@@ -100,16 +143,74 @@ var mainTmpl = `<html>
 </html>
 `
 
+var adminTmpl = `<html>
+<head>
+<meta name="csrf-token" content="{{.CSRFToken}}">
+<script src="static/jquery-3.2.1.min.js" type="text/javascript"></script>
+<script src="static/errors.js" type="text/javascript"></script>
+<script src="static/admin.js" type="text/javascript"></script>
+<link rel="stylesheet" type="text/css" href="static/selfservice.css">
+</head>
+<body>
+<div>
+<img src="static/mig-logo-transparent.png" width="25%">
+</div>
+<div>
+<h1>MIG self-service portal administration</h1>
+</div>
+<div class="intro">
+  <p>Logged in as <i>{{.RemoteUser}}.</i> <a href=".">Return to the portal</a></p>
+  <p>This page lists the loader entries created through the self-service portal for all
+  users. Rekeying an entry will display the new key once, and will enable the entry if it
+  is disabled.</p>
+</div>
+<div>
+  <h2>Self-service loaders</h2>
+  <form id="filterform" autocomplete=off>
+    <p>
+    User <input type="text" id="filteruser">
+    Not used in <input type="number" id="filterstale" min="0" size="4"> days
+    <input type="submit" value="Filter">
+    </p>
+  </form>
+  <table>
+    <thead>
+      <tr>
+      <td>Owner</td><td>Slot</td><td>Enabled</td><td>Last used</td><td>Agent</td><td>Action</td>
+      </tr>
+    </thead>
+    <tbody id="loaders">
+      <tr><td>Loading</td></tr>
+    </tbody>
+  </table>
+</div>
+</body>
+</html>
+`
+
 type templateData struct {
 	RemoteUser       string
+	IsAdmin          bool
+	CSRFToken        string
+	SlotCount        int
+	Slots            []int
 	DownloadWin      string
 	DownloadLinuxRPM string
 	DownloadLinuxDEB string
 	DownloadOSX      string
+	TokensEnabled    bool
+	Logout           bool
+	TokenMaxDays     int
 }
 
 func (t *templateData) importFromRequest(r requestDetails) {
 	t.RemoteUser = r.remoteUser
+	t.IsAdmin = isAdmin(r.remoteUser)
+	t.CSRFToken = r.csrfToken
+	t.SlotCount = r.slots
+	for i := 1; i <= r.slots; i++ {
+		t.Slots = append(t.Slots, i)
+	}
 }
 
 func renderMainPage(rdetails requestDetails) (string, error) {
@@ -122,6 +223,9 @@ func renderMainPage(rdetails requestDetails) (string, error) {
 	tdata.DownloadOSX = cfg.DownloadOSX
 	tdata.DownloadLinuxRPM = cfg.DownloadLinuxRPM
 	tdata.DownloadLinuxDEB = cfg.DownloadLinuxDEB
+	tdata.Logout = oidcProv != nil
+	tdata.TokensEnabled = cfg.Tokens.Enabled
+	tdata.TokenMaxDays = int(cfg.Tokens.withDefaults().MaxLifetime.Hours() / 24)
 	t, err := template.New("main").Parse(mainTmpl)
 	if err != nil {
 		return "", err
@@ -134,3 +238,21 @@ func renderMainPage(rdetails requestDetails) (string, error) {
 	bw.Flush()
 	return outbuf.String(), nil
 }
+
+func renderAdminPage(rdetails requestDetails) (string, error) {
+	var outbuf bytes.Buffer
+
+	tdata := templateData{}
+	tdata.importFromRequest(rdetails)
+	t, err := template.New("admin").Parse(adminTmpl)
+	if err != nil {
+		return "", err
+	}
+	bw := bufio.NewWriter(&outbuf)
+	err = t.Execute(bw, tdata)
+	if err != nil {
+		return "", err
+	}
+	bw.Flush()
+	return outbuf.String(), nil
+}
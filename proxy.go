@@ -0,0 +1,221 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Controls which requests are permitted to identify a user using the REMOTE_USER
+// header. If TrustedCIDRs is set, the header is only accepted from those source
+// addresses. If HMACSecret is set, the proxy must also include an X-Proxy-Signature
+// header of the form <unix time>:<hex HMAC-SHA256 of "<unix time>|<user>">. If
+// AssertionKey is set, the proxy must include an RS256 signed JWT in the
+// X-Proxy-Assertion header whose sub claim matches the user.
+type proxyConfig struct {
+	TrustedCIDRs      []string
+	HMACSecret        string
+	AssertionKey      string        // Path to PEM encoded public key
+	AssertionIssuer   string        // Required iss claim, if set
+	AssertionAudience string        // Required aud claim, if set
+	MaxSkew           time.Duration // Allowed clock skew, default 5m
+}
+
+const (
+	proxySignatureHeader = "X-Proxy-Signature"
+	proxyAssertionHeader = "X-Proxy-Assertion"
+	proxyDefaultMaxSkew  = 5 * time.Minute
+)
+
+// An error resulting from a failed proxy trust check, including the HTTP status
+// that should be returned
+type proxyTrustError struct {
+	status int
+	msg    string
+}
+
+func (p *proxyTrustError) Error() string {
+	return p.msg
+}
+
+type proxyTrust struct {
+	nets         []*net.IPNet
+	secret       []byte
+	assertionKey *rsa.PublicKey
+	issuer       string
+	audience     string
+	maxSkew      time.Duration
+}
+
+var trust proxyTrust
+
+// Initialize proxy trust settings from the configuration
+func (p *proxyTrust) init(conf proxyConfig) error {
+	p.nets = nil
+	for _, x := range conf.TrustedCIDRs {
+		_, n, err := net.ParseCIDR(x)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %v", x, err)
+		}
+		p.nets = append(p.nets, n)
+	}
+	p.secret = []byte(conf.HMACSecret)
+	p.issuer = conf.AssertionIssuer
+	p.audience = conf.AssertionAudience
+	p.maxSkew = conf.MaxSkew
+	if p.maxSkew == 0 {
+		p.maxSkew = proxyDefaultMaxSkew
+	}
+	p.assertionKey = nil
+	if conf.AssertionKey != "" {
+		buf, err := ioutil.ReadFile(conf.AssertionKey)
+		if err != nil {
+			return err
+		}
+		blk, _ := pem.Decode(buf)
+		if blk == nil {
+			return fmt.Errorf("no PEM data found in %v", conf.AssertionKey)
+		}
+		pub, err := x509.ParsePKIXPublicKey(blk.Bytes)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		p.assertionKey, ok = pub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("assertion key must be an RSA public key")
+		}
+	}
+	if len(p.nets) == 0 && len(p.secret) == 0 && p.assertionKey == nil {
+		log.Printf("warning: no proxy trust configured, REMOTE_USER accepted from any client")
+	}
+	return nil
+}
+
+// Returns true if the request was received from a trusted proxy address. Requests
+// received on a Unix socket have no address and are always trusted, as access
+// to the socket is controlled using file system permissions.
+func (p *proxyTrust) trustedSource(r *http.Request) bool {
+	if len(p.nets) == 0 || r.RemoteAddr == "" || r.RemoteAddr == "@" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return p.trustedAddr(host)
+}
+
+// Returns true if addr is an address within one of the trusted proxy networks
+func (p *proxyTrust) trustedAddr(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *proxyTrust) checkSignature(r *http.Request, user string) error {
+	hv := r.Header.Get(proxySignatureHeader)
+	args := strings.SplitN(hv, ":", 2)
+	if len(args) != 2 {
+		return fmt.Errorf("missing or malformed %v header", proxySignatureHeader)
+	}
+	ts, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed %v header", proxySignatureHeader)
+	}
+	d := time.Since(time.Unix(ts, 0))
+	if d > p.maxSkew || d < -p.maxSkew {
+		return fmt.Errorf("%v timestamp outside allowed window", proxySignatureHeader)
+	}
+	sig, err := hex.DecodeString(args[1])
+	if err != nil {
+		return fmt.Errorf("malformed %v header", proxySignatureHeader)
+	}
+	m := hmac.New(sha256.New, p.secret)
+	m.Write([]byte(args[0] + "|" + user))
+	if !hmac.Equal(sig, m.Sum(nil)) {
+		return fmt.Errorf("invalid %v", proxySignatureHeader)
+	}
+	return nil
+}
+
+func (p *proxyTrust) checkAssertion(r *http.Request, user string) error {
+	tok := r.Header.Get(proxyAssertionHeader)
+	if tok == "" {
+		return fmt.Errorf("missing %v header", proxyAssertionHeader)
+	}
+	_, claims, err := parseJWT(tok, func(jwtHeader) (interface{}, error) {
+		return p.assertionKey, nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid assertion: %v", err)
+	}
+	err = claims.validateTimes(p.maxSkew)
+	if err != nil {
+		return fmt.Errorf("invalid assertion: %v", err)
+	}
+	if p.issuer != "" && claims.str("iss") != p.issuer {
+		return fmt.Errorf("assertion has invalid issuer")
+	}
+	if p.audience != "" && !claims.hasAudience(p.audience) {
+		return fmt.Errorf("assertion has invalid audience")
+	}
+	if claims.str("sub") != user {
+		return fmt.Errorf("assertion subject does not match REMOTE_USER")
+	}
+	return nil
+}
+
+// Return the user identified by the REMOTE_USER header, after verifying the request
+// meets the trust requirements in the configuration
+func (p *proxyTrust) remoteUser(r *http.Request) (string, error) {
+	if !p.trustedSource(r) {
+		return "", &proxyTrustError{http.StatusForbidden, "request not received from a trusted proxy"}
+	}
+	// Depending on how the request was parsed the header name may or may not have
+	// been canonicalized, so check for both
+	hslice, ok := r.Header["REMOTE_USER"]
+	if !ok {
+		hslice, ok = r.Header[http.CanonicalHeaderKey("REMOTE_USER")]
+	}
+	if !ok || len(hslice) != 1 || hslice[0] == "" {
+		return "", &proxyTrustError{http.StatusUnauthorized, "invalid header configuration"}
+	}
+	ru := hslice[0]
+	if len(p.secret) != 0 {
+		err := p.checkSignature(r, ru)
+		if err != nil {
+			return "", &proxyTrustError{http.StatusUnauthorized, err.Error()}
+		}
+	}
+	if p.assertionKey != nil {
+		err := p.checkAssertion(r, ru)
+		if err != nil {
+			return "", &proxyTrustError{http.StatusUnauthorized, err.Error()}
+		}
+	}
+	return ru, nil
+}
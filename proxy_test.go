@@ -0,0 +1,205 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Return a JWT with the supplied header and claims, signed using RS256 with key
+func signJWT(t *testing.T, key *rsa.PrivateKey, hdr map[string]string, claims map[string]interface{}) string {
+	hbuf, _ := json.Marshal(hdr)
+	cbuf, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hbuf) + "." + base64.RawURLEncoding.EncodeToString(cbuf)
+	h := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// Return the X-Proxy-Signature header value for user at time ts
+func proxySignature(secret string, ts time.Time, user string) string {
+	tv := strconv.FormatInt(ts.Unix(), 10)
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(tv + "|" + user))
+	return tv + ":" + hex.EncodeToString(m.Sum(nil))
+}
+
+func TestTrustedSource(t *testing.T) {
+	var p proxyTrust
+	if err := p.init(proxyConfig{TrustedCIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remote string
+		want   bool
+	}{
+		{"10.1.2.3:1234", true},
+		{"11.1.2.3:1234", false},
+		{"[2001:db8::1]:1234", true},
+		{"[2001:db9::1]:1234", false},
+		{"garbage", false},
+		// Unix socket listeners
+		{"@", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		if got := p.trustedSource(req); got != tt.want {
+			t.Errorf("trustedSource(%q) = %v, want %v", tt.remote, got, tt.want)
+		}
+	}
+	if err := p.init(proxyConfig{TrustedCIDRs: []string{"10.0.0.1"}}); err == nil {
+		t.Error("init accepted an invalid network")
+	}
+}
+
+func TestProxyRemoteUser(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "assertion.pem")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p proxyTrust
+	err = p.init(proxyConfig{
+		TrustedCIDRs:      []string{"10.0.0.0/8"},
+		HMACSecret:        "secret",
+		AssertionKey:      keyPath,
+		AssertionIssuer:   "proxy",
+		AssertionAudience: "portal",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := "user@example.com"
+	now := time.Now()
+	hdr := map[string]string{"alg": "RS256", "typ": "JWT"}
+	assertion := func(k *rsa.PrivateKey, change map[string]interface{}) string {
+		claims := map[string]interface{}{
+			"iss": "proxy",
+			"aud": "portal",
+			"sub": user,
+			"iat": now.Unix(),
+			"exp": now.Add(time.Minute).Unix(),
+		}
+		for n, v := range change {
+			if v == nil {
+				delete(claims, n)
+				continue
+			}
+			claims[n] = v
+		}
+		return signJWT(t, k, hdr, claims)
+	}
+	valid := assertion(key, nil)
+	// A token claiming no signature is required, carrying a valid token's signature
+	unsigned := signJWT(t, key, map[string]string{"alg": "none"}, map[string]interface{}{"sub": user})
+
+	tests := []struct {
+		name      string
+		remote    string
+		user      string
+		signature string
+		assertion string
+		status    int // 0 if the request is accepted
+	}{
+		{"valid", "10.0.0.1:1234", user, proxySignature("secret", now, user), valid, 0},
+		{"untrusted source", "192.0.2.1:1234", user, proxySignature("secret", now, user), valid, 403},
+		{"no user", "10.0.0.1:1234", "", proxySignature("secret", now, ""), valid, 401},
+		{"no signature", "10.0.0.1:1234", user, "", valid, 401},
+		{"forged signature", "10.0.0.1:1234", user, proxySignature("guess", now, user), valid, 401},
+		{"signature for another user", "10.0.0.1:1234", user,
+			proxySignature("secret", now, "admin@example.com"), valid, 401},
+		{"expired signature", "10.0.0.1:1234", user,
+			proxySignature("secret", now.Add(-10*time.Minute), user), valid, 401},
+		{"future signature", "10.0.0.1:1234", user,
+			proxySignature("secret", now.Add(10*time.Minute), user), valid, 401},
+		{"no assertion", "10.0.0.1:1234", user, proxySignature("secret", now, user), "", 401},
+		{"assertion signed with another key", "10.0.0.1:1234", user,
+			proxySignature("secret", now, user), assertion(other, nil), 401},
+		{"unsigned assertion", "10.0.0.1:1234", user, proxySignature("secret", now, user), unsigned, 401},
+		{"expired assertion", "10.0.0.1:1234", user, proxySignature("secret", now, user),
+			assertion(key, map[string]interface{}{"exp": now.Add(-10 * time.Minute).Unix()}), 401},
+		{"assertion without expiry", "10.0.0.1:1234", user, proxySignature("secret", now, user),
+			assertion(key, map[string]interface{}{"exp": nil}), 401},
+		{"assertion not valid yet", "10.0.0.1:1234", user, proxySignature("secret", now, user),
+			assertion(key, map[string]interface{}{"nbf": now.Add(10 * time.Minute).Unix()}), 401},
+		{"wrong audience", "10.0.0.1:1234", user, proxySignature("secret", now, user),
+			assertion(key, map[string]interface{}{"aud": "other"}), 401},
+		{"audience list", "10.0.0.1:1234", user, proxySignature("secret", now, user),
+			assertion(key, map[string]interface{}{"aud": []string{"other", "portal"}}), 0},
+		{"wrong issuer", "10.0.0.1:1234", user, proxySignature("secret", now, user),
+			assertion(key, map[string]interface{}{"iss": "other"}), 401},
+		{"assertion for another user", "10.0.0.1:1234", user, proxySignature("secret", now, user),
+			assertion(key, map[string]interface{}{"sub": "admin@example.com"}), 401},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.user != "" {
+			req.Header.Set("REMOTE_USER", tt.user)
+		}
+		if tt.signature != "" {
+			req.Header.Set(proxySignatureHeader, tt.signature)
+		}
+		if tt.assertion != "" {
+			req.Header.Set(proxyAssertionHeader, tt.assertion)
+		}
+		ru, err := p.remoteUser(req)
+		if tt.status == 0 {
+			if err != nil || ru != tt.user {
+				t.Errorf("%v: got %q, %v", tt.name, ru, err)
+			}
+			continue
+		}
+		pe, ok := err.(*proxyTrustError)
+		if !ok || pe.status != tt.status || ru != "" {
+			t.Errorf("%v: got %q, %v, want status %v", tt.name, ru, err, tt.status)
+		}
+	}
+
+	// Without any trust configured the header is accepted from any client
+	var open proxyTrust
+	if err := open.init(proxyConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("REMOTE_USER", user)
+	if ru, err := open.remoteUser(req); err != nil || ru != user {
+		t.Errorf("no trust configured: got %q, %v", ru, err)
+	}
+}
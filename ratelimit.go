@@ -0,0 +1,128 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Limits on how often key operations can be requested. Each limit is a token bucket
+// holding up to the burst size, refilled at the given rate per minute; a request
+// takes a token from the bucket for the remote user and from the bucket for the
+// client address, and is only permitted if both hold a token. Buckets are kept in
+// the shared state store so the limits apply across all portal instances. The
+// address limit only applies if the address of the client can be determined; behind
+// a proxy this requires the proxy to be listed in the TrustedCIDRs proxy setting.
+type rateLimitConfig struct {
+	Disabled  bool    // Turn off rate limiting
+	UserRate  float64 // Key operations permitted per minute for each user
+	UserBurst int     // Key operations a user can make at once
+	IPRate    float64 // Key operations permitted per minute from each address
+	IPBurst   int     // Key operations that can be made at once from an address
+}
+
+const (
+	defaultUserRate  = 2
+	defaultUserBurst = 10
+	defaultIPRate    = 10
+	defaultIPBurst   = 30
+)
+
+func (r rateLimitConfig) withDefaults() rateLimitConfig {
+	if r.UserRate == 0 {
+		r.UserRate = defaultUserRate
+	}
+	if r.UserBurst == 0 {
+		r.UserBurst = defaultUserBurst
+	}
+	if r.IPRate == 0 {
+		r.IPRate = defaultIPRate
+	}
+	if r.IPBurst == 0 {
+		r.IPBurst = defaultIPBurst
+	}
+	return r
+}
+
+// Return the time until a bucket refilled at rate tokens per second that currently
+// holds tokens will hold a whole token
+func bucketWait(tokens float64, rate float64) time.Duration {
+	return time.Duration((1 - tokens) / rate * float64(time.Second))
+}
+
+// Return the client address the address limit applies to, or false if it can't be
+// determined. Requests received on a Unix socket have no address, and a request
+// forwarded by a proxy that is not trusted has the address of the proxy, which is
+// shared by every user of the portal.
+func rateLimitAddr(req *http.Request) (string, bool) {
+	if req.RemoteAddr == "" || req.RemoteAddr == "@" {
+		return "", false
+	}
+	ip := clientIP(req)
+	if len(trust.nets) == 0 {
+		if req.Header.Get("X-Forwarded-For") != "" || req.Header.Get("Forwarded") != "" {
+			return "", false
+		}
+		return ip, true
+	}
+	if trust.trustedAddr(ip) {
+		return "", false
+	}
+	return ip, true
+}
+
+// Wraps handlers for key operations, rejecting requests from users or addresses
+// that have exceeded their rate limit
+func rateLimit(
+	h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		conf := cfg.RateLimit.withDefaults()
+		if conf.Disabled {
+			h(rw, req)
+			return
+		}
+		rdetails, err := newRequestDetails(req)
+		if err != nil {
+			writeError(rw, req, errUnauthorized("no valid identity for request", err))
+			return
+		}
+		names := []string{"user"}
+		buckets := []tokenBucket{
+			{"ratelimit:user:" + rdetails.remoteUser, conf.UserRate / 60, conf.UserBurst},
+		}
+		if ip, ok := rateLimitAddr(req); ok {
+			names = append(names, "ip")
+			buckets = append(buckets, tokenBucket{"ratelimit:ip:" + ip, conf.IPRate / 60, conf.IPBurst})
+		}
+		limited, wait, err := shared.take(buckets)
+		if err != nil {
+			writeError(rw, req, errUnavailable(
+				"key operations are currently unavailable, please try again later", err))
+			return
+		}
+		if limited != -1 {
+			name := names[limited]
+			rateLimited.inc(name)
+			ev := newAuditEvent(req, rdetails.remoteUser, auditRateLimited)
+			ev.Reason = name + " limit exceeded"
+			auditor.failure(ev, nil)
+			writeError(rw, req, errRateLimited(
+				"too many key operations have been requested, please try again later",
+				wait, fmt.Errorf("%v limit exceeded for %v", name, buckets[limited].key)))
+			return
+		}
+		h(rw, req)
+	}
+}
+
+// Return the value for a Retry-After header for a wait of d, rounded up to whole
+// seconds
+func retryAfterSeconds(d time.Duration) int {
+	return int(math.Max(1, math.Ceil(d.Seconds())))
+}
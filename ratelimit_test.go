@@ -0,0 +1,123 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// A request rejected by one limit does not use up the other
+func TestRateLimit(t *testing.T) {
+	useMemoryStore(t)
+	useTrustedProxies(t, "192.0.2.0/24")
+	old := cfg.RateLimit
+	cfg.RateLimit = rateLimitConfig{UserRate: 0.001, UserBurst: 2, IPRate: 0.001, IPBurst: 1}
+	t.Cleanup(func() { cfg.RateLimit = old })
+
+	r := mux.NewRouter()
+	r.HandleFunc("/newkey", setContext(rateLimit(func(http.ResponseWriter, *http.Request) {})))
+	tests := []struct {
+		user string
+		ip   string
+		code int
+	}{
+		{"a@x.com", "198.51.100.1", 200},
+		// The address limit is reached, which must not take from the user's bucket
+		{"a@x.com", "198.51.100.1", 429},
+		{"a@x.com", "198.51.100.2", 200},
+		// Both limits are reached
+		{"a@x.com", "198.51.100.2", 429},
+		// The user limit is reached, which must not take from the address bucket
+		{"a@x.com", "198.51.100.3", 429},
+		{"b@x.com", "198.51.100.3", 200},
+	}
+	for i, tt := range tests {
+		rw := serveAs(t, r, tt.user, "POST", "/newkey", "", "X-Forwarded-For", tt.ip)
+		if rw.Code != tt.code {
+			t.Fatalf("request %v from %v at %v: got %v, want %v", i, tt.user, tt.ip, rw.Code, tt.code)
+		}
+	}
+}
+
+func TestRateLimitAddr(t *testing.T) {
+	tests := []struct {
+		trusted []string
+		remote  string
+		xff     string
+		want    string // Empty if the address is unknown
+	}{
+		{nil, "198.51.100.1:1234", "", "198.51.100.1"},
+		// Forwarded by a proxy that is not trusted, so all clients share its address
+		{nil, "192.0.2.1:1234", "198.51.100.1", ""},
+		// Unix socket
+		{nil, "@", "", ""},
+		{[]string{"192.0.2.0/24"}, "192.0.2.1:1234", "198.51.100.1", "198.51.100.1"},
+		// Nothing but trusted proxies
+		{[]string{"192.0.2.0/24"}, "192.0.2.1:1234", "", ""},
+		{[]string{"192.0.2.0/24"}, "@", "198.51.100.1", ""},
+		{[]string{"192.0.2.0/24"}, "198.51.100.2:1234", "", "198.51.100.2"},
+	}
+	for _, tt := range tests {
+		useTrustedProxies(t, tt.trusted...)
+		req := httptest.NewRequest("POST", "/newkey", nil)
+		req.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		ip, ok := rateLimitAddr(req)
+		if ip != tt.want || ok != (tt.want != "") {
+			t.Errorf("trusted %v, remote %v, forwarded for %q: got %q, %v", tt.trusted, tt.remote, tt.xff, ip, ok)
+		}
+	}
+}
+
+// Without trusted proxies, users behind the same proxy are only limited per user
+func TestRateLimitUnknownAddr(t *testing.T) {
+	useMemoryStore(t)
+	useTrustedProxies(t)
+	old := cfg.RateLimit
+	cfg.RateLimit = rateLimitConfig{UserRate: 0.001, UserBurst: 1, IPRate: 0.001, IPBurst: 1}
+	t.Cleanup(func() { cfg.RateLimit = old })
+
+	r := mux.NewRouter()
+	r.HandleFunc("/newkey", setContext(rateLimit(func(http.ResponseWriter, *http.Request) {})))
+	for _, user := range []string{"a@x.com", "b@x.com", "c@x.com"} {
+		rw := serveAs(t, r, user, "POST", "/newkey", "", "X-Forwarded-For", "198.51.100.1")
+		if rw.Code != 200 {
+			t.Fatalf("request from %v: got %v", user, rw.Code)
+		}
+	}
+	rw := serveAs(t, r, "a@x.com", "POST", "/newkey", "", "X-Forwarded-For", "198.51.100.1")
+	if rw.Code != 429 {
+		t.Fatalf("second request from a@x.com: got %v", rw.Code)
+	}
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	m := newMemoryStore()
+	buckets := []tokenBucket{{"a", 0.001, 1}, {"b", 0.001, 2}}
+	limited, _, err := m.take(buckets)
+	if err != nil || limited != -1 {
+		t.Fatalf("first take: got %v, %v", limited, err)
+	}
+	limited, wait, err := m.take(buckets)
+	if err != nil || limited != 0 || wait <= 0 {
+		t.Fatalf("second take: got %v, %v, %v", limited, wait, err)
+	}
+	// Nothing was taken from b by the failed take
+	limited, _, err = m.take(buckets[1:])
+	if err != nil || limited != -1 {
+		t.Fatalf("take from b: got %v, %v", limited, err)
+	}
+	limited, _, err = m.take(buckets[1:])
+	if err != nil || limited != 0 {
+		t.Fatalf("take from empty b: got %v, %v", limited, err)
+	}
+}
@@ -0,0 +1,188 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mozilla/mig"
+)
+
+// Configuration for the reaper, which periodically disables self-service loaders
+// that are no longer in use. The reaper runs if Interval is set.
+type reaperConfig struct {
+	Interval      time.Duration // How often to look for stale loaders
+	MaxIdleDays   int           // Disable loaders not used in this many days
+	NeverUsedDays int           // Disable loaders never used this many days after creation
+	DryRun        bool          // Only record what would be disabled
+}
+
+type loaderReaper struct {
+	conf reaperConfig
+
+	stopc chan bool // Closed to stop the reaper
+	done  chan bool // Closed once the reaper has stopped
+}
+
+var reaper loaderReaper
+
+// Loader entries record when they were last used by an agent, but not when they
+// were last keyed. Record when keys are issued in the shared state store, so a slot
+// that has just been rekeyed by any instance is not immediately considered idle.
+func reaperIssuedKey(name string) string {
+	return "reaper:issued:" + name
+}
+
+// The minimum time the issue time of a key is kept for. Instances that don't run the
+// reaper may not be configured with the same limits as the instance that does, so
+// the time is recorded for at least this long even if the local limits are shorter
+// or not set.
+const reaperIssuedMinDays = 366
+
+// Note that a key was issued for the loader entry
+func (l *loaderReaper) keyIssued(name string) {
+	days := reaperIssuedMinDays
+	if l.conf.MaxIdleDays > days {
+		days = l.conf.MaxIdleDays
+	}
+	if l.conf.NeverUsedDays > days {
+		days = l.conf.NeverUsedDays
+	}
+	err := shared.set(reaperIssuedKey(name), time.Now().UTC().Format(time.RFC3339),
+		time.Duration(days)*24*time.Hour)
+	if err != nil {
+		log.Printf("reaper: unable to record key issued for %v: %v", name, err)
+	}
+}
+
+// Returns true if a key was issued for the loader within d. If the state store
+// is unavailable the key is assumed to have been issued recently, so the entry
+// is left alone until the next pass.
+func (l *loaderReaper) issuedWithin(name string, d time.Duration) bool {
+	v, found, err := shared.get(reaperIssuedKey(name))
+	if err != nil {
+		log.Printf("reaper: unable to check when a key was issued for %v: %v", name, err)
+		return true
+	}
+	if !found {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return false
+	}
+	return time.Since(t) <= d
+}
+
+// Return the reason the loader should be disabled, or an empty string if it should
+// be left alone
+func (l *loaderReaper) staleReason(le mig.LoaderEntry) string {
+	if !le.Enabled {
+		return ""
+	}
+	idle := time.Since(le.LastSeen)
+	// An entry that has never been used by an agent has no agent name, and the last
+	// seen value is the time the entry was created
+	if le.AgentName == "" && l.conf.NeverUsedDays > 0 {
+		d := time.Duration(l.conf.NeverUsedDays) * 24 * time.Hour
+		if idle > d && !l.issuedWithin(le.Name, d) {
+			return fmt.Sprintf("never used %v days after creation", l.conf.NeverUsedDays)
+		}
+	}
+	if l.conf.MaxIdleDays > 0 {
+		d := time.Duration(l.conf.MaxIdleDays) * 24 * time.Hour
+		if idle > d && !l.issuedWithin(le.Name, d) {
+			return fmt.Sprintf("not used in %v days", l.conf.MaxIdleDays)
+		}
+	}
+	return ""
+}
+
+// Returns true if the reaper has been asked to stop
+func (l *loaderReaper) stopping() bool {
+	select {
+	case <-l.stopc:
+		return true
+	default:
+		return false
+	}
+}
+
+// Perform a single pass, disabling any stale loaders. The pass ends early if the
+// reaper is stopped.
+func (l *loaderReaper) reap() error {
+	cli, err := newMIGClient(context.Background())
+	if err != nil {
+		return err
+	}
+	ldrs, err := searchLoaders(cli, "migss-%")
+	if err != nil {
+		return err
+	}
+	for _, le := range ldrs {
+		if l.stopping() {
+			return nil
+		}
+		_, _, err = parseLoaderName(le.Name)
+		if err != nil {
+			continue
+		}
+		reason := l.staleReason(le)
+		if reason == "" {
+			continue
+		}
+		ev := newSystemAuditEvent(auditExpire)
+		ev.setLoader(le)
+		ev.Reason = reason
+		ev.DryRun = l.conf.DryRun
+		if l.conf.DryRun {
+			auditor.success(ev)
+			continue
+		}
+		err = cli.LoaderEntryStatus(le, false)
+		if err != nil {
+			auditor.failure(ev, err)
+			continue
+		}
+		auditor.success(ev)
+	}
+	return nil
+}
+
+// Start running the reaper at the configured interval
+func (l *loaderReaper) start() {
+	l.stopc = make(chan bool)
+	l.done = make(chan bool)
+	go l.run()
+}
+
+func (l *loaderReaper) run() {
+	defer close(l.done)
+	for {
+		err := l.reap()
+		if err != nil {
+			log.Printf("reaper: %v", err)
+		}
+		select {
+		case <-l.stopc:
+			return
+		case <-time.After(l.conf.Interval):
+		}
+	}
+}
+
+// Stop the reaper if it is running, waiting for a pass in progress to finish
+func (l *loaderReaper) stop() {
+	if l.stopc == nil {
+		return
+	}
+	close(l.stopc)
+	<-l.done
+	l.stopc = nil
+}
@@ -0,0 +1,77 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mozilla/mig"
+)
+
+// Use a new in-memory shared state store for the duration of the test
+func useMemoryStore(t *testing.T) {
+	old := shared
+	shared = newMemoryStore()
+	t.Cleanup(func() { shared = old })
+}
+
+// A key issued by one instance must keep the entry from being reaped by another
+func TestReaperKeyIssued(t *testing.T) {
+	useMemoryStore(t)
+	conf := reaperConfig{MaxIdleDays: 30, NeverUsedDays: 7}
+	a := loaderReaper{conf: conf}
+	b := loaderReaper{conf: conf}
+
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	unused := mig.LoaderEntry{Name: "migss-user@x.com-1", Enabled: true, LastSeen: old}
+	idle := mig.LoaderEntry{Name: "migss-user@x.com-2", Enabled: true, LastSeen: old, AgentName: "host"}
+	if b.staleReason(unused) == "" || b.staleReason(idle) == "" {
+		t.Fatal("stale entries not reported")
+	}
+	a.keyIssued(unused.Name)
+	a.keyIssued(idle.Name)
+	if r := b.staleReason(unused); r != "" {
+		t.Fatalf("rekeyed unused entry reported stale: %v", r)
+	}
+	if r := b.staleReason(idle); r != "" {
+		t.Fatalf("rekeyed idle entry reported stale: %v", r)
+	}
+
+	// A key issued longer ago than the limit does not protect the entry
+	err := shared.set(reaperIssuedKey(unused.Name),
+		time.Now().Add(-8*24*time.Hour).UTC().Format(time.RFC3339), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.staleReason(unused) == "" {
+		t.Fatal("entry rekeyed before the limit not reported")
+	}
+}
+
+// An instance that does not run the reaper, and has none of its limits configured,
+// still records keys it issues for the instance that does
+func TestReaperKeyIssuedOtherConfig(t *testing.T) {
+	useMemoryStore(t)
+	issuing := loaderReaper{}
+	reaping := loaderReaper{conf: reaperConfig{Interval: time.Hour, MaxIdleDays: 120, NeverUsedDays: 100}}
+
+	old := time.Now().Add(-200 * 24 * time.Hour)
+	unused := mig.LoaderEntry{Name: "migss-user@x.com-1", Enabled: true, LastSeen: old}
+	idle := mig.LoaderEntry{Name: "migss-user@x.com-2", Enabled: true, LastSeen: old, AgentName: "host"}
+	issuing.keyIssued(unused.Name)
+	issuing.keyIssued(idle.Name)
+	if r := reaping.staleReason(unused); r != "" {
+		t.Fatalf("rekeyed unused entry reported stale: %v", r)
+	}
+	if r := reaping.staleReason(idle); r != "" {
+		t.Fatalf("rekeyed idle entry reported stale: %v", r)
+	}
+	m := shared.(*memoryStore)
+	if v, ok := m.values[reaperIssuedKey(unused.Name)]; !ok || time.Until(v.expires) < 120*24*time.Hour {
+		t.Fatalf("issue time not kept for the reaping instance's limit: %+v", v)
+	}
+}
@@ -0,0 +1,326 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal redis client, supporting the handful of commands needed to share state
+// between portal instances
+
+// Timeout for connecting to redis and for each command
+const redisTimeout = 5 * time.Second
+
+// The number of idle connections kept for reuse
+const redisIdleConns = 8
+
+// An error reply from the server
+type redisError string
+
+func (r redisError) Error() string {
+	return "redis: " + string(r)
+}
+
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+func newRedisClient(addr string, password string, db int) *redisClient {
+	return &redisClient{addr: addr, password: password, db: db,
+		idle: make(chan *redisConn, redisIdleConns)}
+}
+
+func (r *redisClient) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", r.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, rd: bufio.NewReader(conn)}
+	if r.password != "" {
+		_, err = rc.do("AUTH", r.password)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		_, err = rc.do("SELECT", strconv.Itoa(r.db))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// Run a command, returning the reply. Replies are returned as a string for simple
+// and bulk strings, int64 for integers, nil for a null reply and []interface{} for
+// arrays. An error reply is returned as a redisError.
+func (r *redisClient) do(args ...string) (interface{}, error) {
+	var (
+		rc  *redisConn
+		err error
+	)
+	select {
+	case rc = <-r.idle:
+	default:
+		rc, err = r.dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ret, err := rc.do(args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// The connection is in an unknown state, so don't reuse it
+			rc.conn.Close()
+			return nil, err
+		}
+	}
+	select {
+	case r.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return ret, err
+}
+
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := io.WriteString(rc.conn, sb.String())
+	if err != nil {
+		return nil, err
+	}
+	return rc.reply()
+}
+
+func (rc *redisConn) line() (string, error) {
+	l, err := rc.rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(l, "\r\n") {
+		return "", fmt.Errorf("redis: malformed reply")
+	}
+	return l[:len(l)-2], nil
+}
+
+func (rc *redisConn) reply() (interface{}, error) {
+	l, err := rc.line()
+	if err != nil {
+		return nil, err
+	}
+	if l == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch l[0] {
+	case '+':
+		return l[1:], nil
+	case '-':
+		return nil, redisError(l[1:])
+	case ':':
+		return strconv.ParseInt(l[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(l[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(rc.rd, buf)
+		if err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(l[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		ret := make([]interface{}, n)
+		for i := range ret {
+			ret[i], err = rc.reply()
+			if err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				ret[i] = err
+			}
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", l[0])
+}
+
+// Deletes a lock only if it is still held with our token, so a lock that expired and
+// was acquired by someone else is not released
+const redisUnlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`
+
+// Takes a token from each of the token buckets in KEYS, only if all of them hold one.
+// The bucket in KEYS[i] is refilled at ARGV[2i-1] tokens per second up to ARGV[2i]
+// tokens. Returns 0 if the tokens were taken, or the index of the first empty
+// bucket and the tokens it holds if not. The server's clock is used so instances
+// with different clocks share the same view of each bucket.
+const redisTakeScript = `local t = redis.call("time")
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local tokens = {}
+local limited = 0
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[2 * i - 1])
+	local burst = tonumber(ARGV[2 * i])
+	local b = redis.call("hmget", key, "tokens", "updated")
+	local n = tonumber(b[1]) or burst
+	local updated = tonumber(b[2]) or now
+	tokens[i] = math.min(burst, n + math.max(0, now - updated) * rate)
+	if tokens[i] < 1 and limited == 0 then
+		limited = i
+	end
+end
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[2 * i - 1])
+	local burst = tonumber(ARGV[2 * i])
+	local n = tokens[i]
+	if limited == 0 then
+		n = n - 1
+	end
+	redis.call("hmset", key, "tokens", tostring(n), "updated", tostring(now))
+	redis.call("pexpire", key, math.ceil(burst / rate * 1000))
+end
+if limited == 0 then
+	return {0, "0"}
+end
+return {limited, tostring(tokens[limited])}`
+
+// A store that keeps state in redis, so it can be shared by more than one instance
+type redisStore struct {
+	cli    *redisClient
+	prefix string
+}
+
+func newRedisStore(conf stateConfig) *redisStore {
+	return &redisStore{
+		cli:    newRedisClient(conf.RedisAddress, conf.RedisPassword, conf.RedisDB),
+		prefix: conf.KeyPrefix,
+	}
+}
+
+func (r *redisStore) lock(name string, ttl time.Duration, wait time.Duration) (func(), error) {
+	key := r.prefix + "lock:" + name
+	token, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	deadline := time.Now().Add(wait)
+	delay := 25 * time.Millisecond
+	for {
+		rep, err := r.cli.do("SET", key, token, "NX", "PX", ms)
+		if err != nil {
+			return nil, err
+		}
+		if rep != nil {
+			break
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, errLockTimeout
+		}
+		time.Sleep(delay)
+		if delay < 500*time.Millisecond {
+			delay *= 2
+		}
+	}
+	return func() {
+		_, err := r.cli.do("EVAL", redisUnlockScript, "1", key, token)
+		if err != nil {
+			// The lock will be released when it expires
+			log.Printf("redis: unable to release lock %v: %v", name, err)
+		}
+	}, nil
+}
+
+func (r *redisStore) get(key string) (string, bool, error) {
+	rep, err := r.cli.do("GET", r.prefix+key)
+	if err != nil {
+		return "", false, err
+	}
+	if rep == nil {
+		return "", false, nil
+	}
+	v, ok := rep.(string)
+	if !ok {
+		return "", false, fmt.Errorf("redis: unexpected reply to GET")
+	}
+	return v, true, nil
+}
+
+func (r *redisStore) set(key string, value string, ttl time.Duration) error {
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	_, err := r.cli.do("SET", r.prefix+key, value, "PX", ms)
+	return err
+}
+
+func (r *redisStore) take(buckets []tokenBucket) (int, time.Duration, error) {
+	args := []string{"EVAL", redisTakeScript, strconv.Itoa(len(buckets))}
+	for _, b := range buckets {
+		args = append(args, r.prefix+b.key)
+	}
+	for _, b := range buckets {
+		args = append(args, strconv.FormatFloat(b.rate, 'g', -1, 64), strconv.Itoa(b.burst))
+	}
+	rep, err := r.cli.do(args...)
+	if err != nil {
+		return -1, 0, err
+	}
+	v, ok := rep.([]interface{})
+	if !ok || len(v) != 2 {
+		return -1, 0, fmt.Errorf("redis: unexpected reply to bucket script")
+	}
+	limited, ok := v[0].(int64)
+	if !ok || limited < 0 || limited > int64(len(buckets)) {
+		return -1, 0, fmt.Errorf("redis: unexpected reply to bucket script")
+	}
+	ts, ok := v[1].(string)
+	if !ok {
+		return -1, 0, fmt.Errorf("redis: unexpected reply to bucket script")
+	}
+	tokens, err := strconv.ParseFloat(ts, 64)
+	if err != nil {
+		return -1, 0, err
+	}
+	if limited == 0 {
+		return -1, 0, nil
+	}
+	return int(limited) - 1, bucketWait(tokens, buckets[limited-1].rate), nil
+}
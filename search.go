@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"github.com/mozilla/mig"
+	"github.com/mozilla/mig/client"
+	migdbsearch "github.com/mozilla/mig/database/search"
+)
+
+// The number of results requested from the API in each search request
+const searchPageSize = 100
+
+// Search for loader entries with names matching pattern, requesting results from
+// the API one page at a time
+func searchLoaders(cli migClient, pattern string) (ret []mig.LoaderEntry, err error) {
+	seen := make(map[float64]bool)
+	p := migdbsearch.NewParameters()
+	p.Type = "loader"
+	p.LoaderName = pattern
+	p.Limit = searchPageSize
+	for {
+		vals, err := cli.Search(p, "loader")
+		if err != nil {
+			// Determine if it was a 404, if so there are no more results
+			if isNotFound(err) {
+				return ret, nil
+			}
+			return nil, err
+		}
+		added := 0
+		for _, v := range vals {
+			le, err := client.ValueToLoaderEntry(v)
+			if err != nil {
+				return nil, err
+			}
+			// Guard against an API that does not honor the offset, in which
+			// case we would see the same entries again
+			if seen[le.ID] {
+				continue
+			}
+			seen[le.ID] = true
+			ret = append(ret, le)
+			added++
+		}
+		if len(vals) < searchPageSize || added == 0 {
+			break
+		}
+		p.Offset += searchPageSize
+	}
+	return ret, nil
+}
+
+// The number of agents requested when looking up the agents using a loader entry
+const agentSearchLimit = 10
+
+// Return the agents that have enrolled using loader entry le, most recent first.
+// The search API can't filter agents by loader name, so agents are located using the
+// agent name the loader entry recorded when it was last used; if the API includes the
+// loader name in the results it is used to discard agents using a different entry.
+func searchLoaderAgents(cli migClient, le mig.LoaderEntry) (ret []mig.Agent, err error) {
+	if le.AgentName == "" {
+		return
+	}
+	p := migdbsearch.NewParameters()
+	p.Type = "agent"
+	p.AgentName = escapeLike(le.AgentName)
+	p.Limit = agentSearchLimit
+	vals, err := cli.Search(p, "agent")
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, v := range vals {
+		agt, err := client.ValueToAgent(v)
+		if err != nil {
+			return nil, err
+		}
+		if agt.Name != le.AgentName {
+			continue
+		}
+		if agt.LoaderName != "" && agt.LoaderName != le.Name {
+			continue
+		}
+		ret = append(ret, agt)
+	}
+	return ret, nil
+}
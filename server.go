@@ -0,0 +1,300 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Listener configuration. Address is either host:port, or unix:<path> to listen on
+// a Unix socket. TLS is used if TLSCert and TLSKey are set. On SIGHUP the listener
+// configuration is read again and the certificate reloaded; if the listener
+// settings have changed the listener is restarted.
+type listenConfig struct {
+	Address         string
+	TLSCert         string
+	TLSKey          string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration // Time allowed for requests to complete on shutdown
+}
+
+const (
+	defaultListenAddress   = ":2000"
+	defaultReadTimeout     = 30 * time.Second
+	defaultWriteTimeout    = 60 * time.Second
+	defaultIdleTimeout     = 120 * time.Second
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+func (l listenConfig) withDefaults() listenConfig {
+	if l.Address == "" {
+		l.Address = defaultListenAddress
+	}
+	if l.ReadTimeout == 0 {
+		l.ReadTimeout = defaultReadTimeout
+	}
+	if l.WriteTimeout == 0 {
+		l.WriteTimeout = defaultWriteTimeout
+	}
+	if l.IdleTimeout == 0 {
+		l.IdleTimeout = defaultIdleTimeout
+	}
+	if l.ShutdownTimeout == 0 {
+		l.ShutdownTimeout = defaultShutdownTimeout
+	}
+	return l
+}
+
+func (l listenConfig) useTLS() bool {
+	return l.TLSCert != "" && l.TLSKey != ""
+}
+
+// Create the listener described by the configuration
+func (l listenConfig) listen() (net.Listener, error) {
+	if strings.HasPrefix(l.Address, "unix:") {
+		path := strings.TrimPrefix(l.Address, "unix:")
+		// Remove a socket left behind by a previous instance
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", l.Address)
+}
+
+// Tracks key operations in progress; on shutdown we wait for these to complete even
+// if the shutdown timeout expires, so a key is never left half created
+type keyOpTracker struct {
+	sync.Mutex
+	wg     sync.WaitGroup
+	closed bool
+}
+
+var keyOps keyOpTracker
+
+// Register the start of a key operation, returning false if shutdown has begun
+func (k *keyOpTracker) start() bool {
+	k.Lock()
+	defer k.Unlock()
+	if k.closed {
+		return false
+	}
+	k.wg.Add(1)
+	return true
+}
+
+func (k *keyOpTracker) done() {
+	k.wg.Done()
+}
+
+// Refuse any new key operations
+func (k *keyOpTracker) close() {
+	k.Lock()
+	k.closed = true
+	k.Unlock()
+}
+
+// Refuse any new key operations and wait for those in progress to complete
+func (k *keyOpTracker) drain() {
+	k.close()
+	k.wg.Wait()
+}
+
+// Wrap a handler that changes loader entries so it is tracked in keyOps
+func trackKeyOp(h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if !keyOps.start() {
+			writeError(rw, req, errUnavailable("the portal is shutting down, please try again later", nil))
+			return
+		}
+		defer keyOps.done()
+		h(rw, req)
+	}
+}
+
+type portalServer struct {
+	handler  http.Handler
+	confpath string
+	errc     chan error
+
+	sync.Mutex
+	conf listenConfig
+	srv  *http.Server
+	cert *tls.Certificate
+}
+
+func newPortalServer(h http.Handler, confpath string) *portalServer {
+	return &portalServer{handler: h, confpath: confpath, errc: make(chan error, 1)}
+}
+
+func (p *portalServer) loadCert(conf listenConfig) error {
+	cert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+	if err != nil {
+		return err
+	}
+	p.cert = &cert
+	return nil
+}
+
+func (p *portalServer) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.Lock()
+	defer p.Unlock()
+	return p.cert, nil
+}
+
+// Start serving using conf; must be called with the lock held
+func (p *portalServer) start(conf listenConfig) error {
+	if conf.useTLS() {
+		err := p.loadCert(conf)
+		if err != nil {
+			return err
+		}
+	}
+	ln, err := conf.listen()
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:      p.handler,
+		ReadTimeout:  conf.ReadTimeout,
+		WriteTimeout: conf.WriteTimeout,
+		IdleTimeout:  conf.IdleTimeout,
+	}
+	if conf.useTLS() {
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: p.getCertificate,
+		}
+	}
+	go func() {
+		var err error
+		if conf.useTLS() {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			select {
+			case p.errc <- err:
+			default:
+			}
+		}
+	}()
+	log.Printf("listening on %v", conf.Address)
+	p.conf = conf
+	p.srv = srv
+	return nil
+}
+
+// Gracefully stop srv, allowing in progress requests up to timeout to complete
+func stopServer(srv *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// Read the listener configuration again, reloading the certificate and restarting
+// the listener if required
+func (p *portalServer) reload() error {
+	c, err := readConfig(p.confpath)
+	if err != nil {
+		return err
+	}
+	nc := c.Listen.withDefaults()
+	p.Lock()
+	defer p.Unlock()
+	if nc == p.conf {
+		if nc.useTLS() {
+			log.Printf("reloading certificate")
+			return p.loadCert(nc)
+		}
+		return nil
+	}
+	log.Printf("listener configuration changed, restarting listener")
+	old := p.srv
+	oldconf := p.conf
+	if nc.Address == oldconf.Address {
+		// We can't bind the new listener until the old one is closed
+		err = stopServer(old, oldconf.ShutdownTimeout)
+		if err != nil {
+			log.Printf("error stopping listener: %v", err)
+		}
+		err = p.start(nc)
+		if err != nil {
+			// Try to put the previous listener back
+			log.Printf("error starting listener: %v", err)
+			return p.start(oldconf)
+		}
+		return nil
+	}
+	err = p.start(nc)
+	if err != nil {
+		return err
+	}
+	go func() {
+		err := stopServer(old, oldconf.ShutdownTimeout)
+		if err != nil {
+			log.Printf("error stopping previous listener: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Gracefully shut down, waiting for key operations in progress and any reaper pass
+// to finish. New key operations are refused from the start, including any received
+// while other requests are allowed to complete.
+func (p *portalServer) shutdown() error {
+	p.Lock()
+	srv := p.srv
+	timeout := p.conf.ShutdownTimeout
+	p.Unlock()
+	keyOps.close()
+	reaper.stop()
+	err := stopServer(srv, timeout)
+	keyOps.drain()
+	return err
+}
+
+// Start the server and handle signals until shut down
+func (p *portalServer) run(conf listenConfig) error {
+	p.Lock()
+	err := p.start(conf.withDefaults())
+	p.Unlock()
+	if err != nil {
+		return err
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for {
+		select {
+		case err = <-p.errc:
+			return fmt.Errorf("server failed: %v", err)
+		case sig := <-sigc:
+			if sig == syscall.SIGHUP {
+				err = p.reload()
+				if err != nil {
+					log.Printf("reload failed: %v", err)
+				}
+				continue
+			}
+			log.Printf("received %v, shutting down", sig)
+			return p.shutdown()
+		}
+	}
+}
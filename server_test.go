@@ -0,0 +1,116 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Once shutdown begins, new key operations are refused while those already running
+// are waited for
+func TestKeyOpDrain(t *testing.T) {
+	keyOps = keyOpTracker{}
+	t.Cleanup(func() { keyOps = keyOpTracker{} })
+
+	started, release := make(chan bool), make(chan bool)
+	h := trackKeyOp(func(rw http.ResponseWriter, req *http.Request) {
+		started <- true
+		<-release
+	})
+	go h(httptest.NewRecorder(), httptest.NewRequest("POST", "/newkey", nil))
+	<-started
+
+	drained := make(chan bool)
+	go func() {
+		keyOps.drain()
+		close(drained)
+	}()
+	// Wait for drain to mark the tracker closed
+	for {
+		keyOps.Lock()
+		closed := keyOps.closed
+		keyOps.Unlock()
+		if closed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rw := httptest.NewRecorder()
+	trackKeyOp(func(http.ResponseWriter, *http.Request) {
+		t.Error("key operation started during shutdown")
+	})(rw, httptest.NewRequest("POST", "/newkey", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Fatalf("key operation during shutdown: got %v", rw.Code)
+	}
+
+	select {
+	case <-drained:
+		t.Fatal("drain returned with a key operation in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-drained
+}
+
+// Key operations are refused as soon as shutdown begins, while other requests are
+// still allowed to complete, and the reaper is stopped
+func TestShutdown(t *testing.T) {
+	keyOps = keyOpTracker{}
+	useMemoryBackend(t)
+	oldReaper := reaper
+	reaper = loaderReaper{conf: reaperConfig{Interval: time.Hour}}
+	t.Cleanup(func() {
+		keyOps = keyOpTracker{}
+		reaper = oldReaper
+	})
+	reaper.start()
+
+	started, release := make(chan bool), make(chan bool)
+	srv := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		started <- true
+		<-release
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	go http.Get("http://" + ln.Addr().String() + "/")
+	<-started
+
+	p := &portalServer{srv: srv, conf: listenConfig{ShutdownTimeout: time.Minute}}
+	stopped := make(chan error)
+	go func() {
+		stopped <- p.shutdown()
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for keyOps.start() {
+		keyOps.done()
+		if time.Now().After(deadline) {
+			t.Fatal("key operations accepted after shutdown began")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-reaper.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reaper not stopped")
+	}
+	select {
+	case <-stopped:
+		t.Fatal("shutdown returned with a request in progress")
+	default:
+	}
+	close(release)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}
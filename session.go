@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Return a random URL safe string containing n bytes of entropy
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Sign value with key, returning a string suitable for storage in a cookie. The
+// purpose and expiry time are included in the signed data and are checked by
+// verifyValue, so a value signed for one purpose can't be used for another even
+// if the same key is used.
+func signValue(key []byte, purpose string, value string, expires time.Time) string {
+	payload := purpose + "|" + strconv.FormatInt(expires.Unix(), 10) + "|" + value
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// Verify a string created with signValue for purpose and return the original value
+func verifyValue(key []byte, purpose string, signed string) (string, error) {
+	args := strings.Split(signed, ".")
+	if len(args) != 2 {
+		return "", fmt.Errorf("invalid signed value")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(args[0])
+	if err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(args[1])
+	if err != nil {
+		return "", err
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write(payload)
+	if !hmac.Equal(sig, m.Sum(nil)) {
+		return "", fmt.Errorf("invalid signature")
+	}
+	fields := strings.SplitN(string(payload), "|", 3)
+	if len(fields) != 3 {
+		return "", fmt.Errorf("invalid signed value")
+	}
+	if fields[0] != purpose {
+		return "", fmt.Errorf("signed value is not valid for %v", purpose)
+	}
+	exp, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", err
+	}
+	if time.Now().After(time.Unix(exp, 0)) {
+		return "", fmt.Errorf("signed value has expired")
+	}
+	return fields[2], nil
+}
@@ -0,0 +1,102 @@
+function csrfToken() {
+	return $("meta[name=\"csrf-token\"]").attr("content");
+}
+
+function lastUsed(ts) {
+	var ldate = new Date(ts);
+	var n = new Date();
+	var timeDiff = Math.abs(n.getTime() - ldate.getTime());
+	var diffDays = Math.ceil(timeDiff / (1000 * 3600 * 24)) - 1;
+	if (diffDays == 0) {
+		return "Today";
+	} else if (diffDays == 1) {
+		return "Yesterday";
+	}
+	return diffDays + " days ago";
+}
+
+function loaderAction(url, id, success) {
+	$.ajax({
+		url: url,
+		type: "post",
+		dataType: "text",
+		contentType: "application/json",
+		headers: { "X-CSRF-Token": csrfToken() },
+		data: JSON.stringify({ "id": id }),
+		success: success,
+		error: showError
+	});
+}
+
+function disableFunc(id) {
+	return function() {
+		if (!confirm("Disable this loader entry?")) {
+			return false;
+		}
+		loaderAction("admin/disable", id, loadLoaders);
+		return false;
+	}
+}
+
+function rekeyFunc(id, row) {
+	return function() {
+		if (!confirm("Rekey this loader entry?")) {
+			return false;
+		}
+		loaderAction("admin/rekey", id, function(data) {
+			var reply = JSON.parse(data);
+			$.ajax({
+				url: "key/" + encodeURIComponent(reply["token"]),
+				dataType: "json",
+				success: function(kdata) {
+					row.find("td").eq(5).text(kdata["key"]);
+				},
+				error: showError
+			});
+		});
+		return false;
+	}
+}
+
+function loaderParser(data) {
+	var tbody = $("#loaders");
+	tbody.empty();
+	if (data.loaders.length == 0) {
+		tbody.append($("<tr>").append($("<td>").text("No matching loaders")));
+		return;
+	}
+	for (var i = 0; i < data.loaders.length; i++) {
+		var ldr = data.loaders[i];
+		var row = $("<tr>");
+		row.append($("<td>").text(ldr["owner"]));
+		row.append($("<td>").text(ldr["slot"]));
+		row.append($("<td>").text(ldr["enabled"] ? "Yes" : "No"));
+		row.append($("<td>").text(lastUsed(ldr["lastseen"])));
+		row.append($("<td>").text(ldr["agentname"]));
+		var act = $("<td>");
+		if (ldr["enabled"]) {
+			act.append($("<a href=\"#\">Disable</a>").on("click", disableFunc(ldr["id"])));
+			act.append(" ");
+		}
+		act.append($("<a href=\"#\">Rekey</a>").on("click", rekeyFunc(ldr["id"], row)));
+		row.append(act);
+		tbody.append(row);
+	}
+}
+
+function loadLoaders() {
+	$.ajax({
+		url: "admin/loaders",
+		data: { "user": $("#filteruser").val(), "stale": $("#filterstale").val() },
+		success: loaderParser,
+		error: showError
+	});
+}
+
+$(document).ready(function() {
+	$("#filterform").submit(function() {
+		loadLoaders();
+		return false;
+	});
+	loadLoaders();
+});
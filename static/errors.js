@@ -0,0 +1,28 @@
+// Return a message describing a failed request; the portal returns errors as
+// {code, message, request_id}, if the response is not in that form fall back to
+// the status text
+function errorMessage(xhr, error) {
+	var body = xhr.responseJSON;
+	if (body === undefined) {
+		try {
+			body = JSON.parse(xhr.responseText);
+		} catch (e) {
+			body = undefined;
+		}
+	}
+	if (body && body["message"]) {
+		var msg = body["message"];
+		if (body["request_id"]) {
+			msg += " (request ID " + body["request_id"] + ")";
+		}
+		return msg;
+	}
+	if (xhr.status == 0) {
+		return "Unable to contact the portal, please try again later";
+	}
+	return "Request failed: " + (error || xhr.status);
+}
+
+function showError(xhr, status, error) {
+	alert(errorMessage(xhr, error));
+}
@@ -8,8 +8,25 @@ function ldrToSlot(ldrname) {
 	return "slot" + slotnum
 }
 
+function slotCount() {
+	return parseInt($("#slots").data("slots"));
+}
+
+function slotDevice(data, slotnum) {
+	for (var k = 0; k < data.agents.length; k++) {
+		var agt = data.agents[k];
+		if (agt["slot"] == slotnum) {
+			var hb = new Date(agt["heartbeatts"]);
+			return agt["hostname"] + " (" + agt["os"] + "/" + agt["arch"] + ", version " +
+				agt["version"] + ", " + agt["status"] + ", last seen " +
+				hb.toLocaleString() + ")";
+		}
+	}
+	return "Not enrolled";
+}
+
 function keyParser(data) {
-	for (var i = 1; i < 4; i++) {
+	for (var i = 1; i <= slotCount(); i++) {
 		var found = false;
 		for (var j = 0; j < data.loaders.length; j++) {
 			ldr = data.loaders[j];
@@ -25,7 +42,11 @@ function keyParser(data) {
 				var timeDiff = Math.abs(n.getTime() - ldate.getTime());
 				var diffDays = Math.ceil(timeDiff / (1000 * 3600 * 24)) - 1;
 				t = $("#" + slotid).find("td");
-				t.eq(1).html("Assigned");
+				if (pendingKey(slotid) !== undefined) {
+					showPendingKey(slotid);
+				} else {
+					t.eq(1).html("Assigned");
+				}
 				t.eq(2).html("<a id=\"" + slotid + "\" href=\"#\">Remove</a>").on("click.rem", removeFunc(slotid));
 				if (diffDays == 0) {
 					t.eq(3).html("Today");
@@ -34,6 +55,7 @@ function keyParser(data) {
 				} else {
 					t.eq(3).html(diffDays + " days ago");
 				}
+				t.eq(4).text(slotDevice(data, i));
 				found = true;
 				break;
 			}
@@ -42,13 +64,45 @@ function keyParser(data) {
 			continue;
 		}
 		var slotid = "slot" + i;
+		clearPendingKey(slotid);
 		t = $("#" + slotid).find("td");
 		t.eq(1).html("Not set");
 		t.eq(2).html("<a id=\"" + slotid + "\" href=\"#\">Generate key</a>").on("click.gen", generateFunc(slotid));
 		t.eq(3).html("N/A");
+		t.eq(4).html("N/A");
+	}
+}
+
+// Entries in slots above the user's quota, left from when the quota was larger, are
+// listed so they can still be removed
+function overQuotaParser(data) {
+	$("#slots tr.overquota").remove();
+	for (var j = 0; j < data.loaders.length; j++) {
+		var ldr = data.loaders[j];
+		var slotid = ldrToSlot(ldr["name"]);
+		if (ldr["enabled"] == false || slotid === undefined) {
+			continue;
+		}
+		var slotnum = parseInt(slotid.slice(4));
+		if (slotnum <= slotCount()) {
+			continue;
+		}
+		var row = $("<tr class=\"overquota\"></tr>").attr("id", slotid);
+		$("#slots thead td").each(function() {
+			row.append("<td>N/A</td>");
+		});
+		t = row.find("td");
+		t.eq(0).text(slotnum);
+		t.eq(1).html("Over quota");
+		t.eq(2).html("<a href=\"#\">Remove</a>").on("click.rem", removeFunc(slotid));
+		$("#slots tbody").append(row);
 	}
 }
 
+function csrfToken() {
+	return $("meta[name=\"csrf-token\"]").attr("content");
+}
+
 function removeFunc(slotid) {
 	return function() {
 		$.ajax({
@@ -56,26 +110,117 @@ function removeFunc(slotid) {
 			type: "post",
 			dataType: "text",
 			contentType: "application/json",
+			headers: { "X-CSRF-Token": csrfToken() },
 			data: JSON.stringify({ "slot": slotid }),
 			success: loadKeys,
-			error: function(xhr, status, error) {
-				alert(error);
-			}
+			error: showError
 		});
 	}
 }
 
+// Generate a random key identifying a single key request, so the request is not
+// performed twice if it is repeated
+function idempotencyKey() {
+	var buf = new Uint8Array(16);
+	window.crypto.getRandomValues(buf);
+	return Array.from(buf, function(b) {
+		return ("0" + b.toString(16)).slice(-2);
+	}).join("");
+}
+
 function generateFunc(slotid) {
 	return function() {
+		// Ignore further clicks while the request is in progress
+		$("#" + slotid).find("td").eq(2).off("click.gen");
 		$.ajax({
 			url: "/newkey",
 			type: "post",
 			dataType: "json",
 			contentType: "application/json",
+			headers: { "X-CSRF-Token": csrfToken(), "Idempotency-Key": idempotencyKey() },
 			data: JSON.stringify({ "slot": slotid }),
 			success: showInitialKey,
 			error: function(xhr, status, error) {
-				alert(error);
+				showError(xhr, status, error);
+				loadKeys();
+			}
+		});
+	}
+}
+
+// Keys that have been generated but not yet retrieved are kept in session storage,
+// so the key can still be retrieved if the page is reloaded
+function pendingKeys() {
+	var p = JSON.parse(window.sessionStorage.getItem("pendingkeys") || "{}");
+	var n = new Date();
+	for (var slotid in p) {
+		if (new Date(p[slotid]["expires"]) <= n) {
+			delete p[slotid];
+		}
+	}
+	return p;
+}
+
+function pendingKey(slotid) {
+	return pendingKeys()[slotid];
+}
+
+function setPendingKey(slotid, data) {
+	var p = pendingKeys();
+	p[slotid] = { "token": data["token"], "expires": data["expires"] };
+	window.sessionStorage.setItem("pendingkeys", JSON.stringify(p));
+}
+
+function clearPendingKey(slotid) {
+	var p = pendingKeys();
+	delete p[slotid];
+	window.sessionStorage.setItem("pendingkeys", JSON.stringify(p));
+}
+
+function showPendingKey(slotid) {
+	var pending = pendingKey(slotid);
+	var exp = new Date(pending["expires"]);
+	t = $("#" + slotid).find("td");
+	var base = "key/" + encodeURIComponent(pending["token"]);
+	t.eq(1).html("<a class=\"showkey\" href=\"#\">Show key</a>, " +
+		"<a class=\"dlkey\" href=\"" + base + "/download\">download mig-loader.key</a>, " +
+		"download an installer for " +
+		"<a class=\"dlkey\" href=\"" + base + "/bundle/linux\">Linux</a>, " +
+		"<a class=\"dlkey\" href=\"" + base + "/bundle/macos\">macOS</a> or " +
+		"<a class=\"dlkey\" href=\"" + base + "/bundle/windows\">Windows</a>, " +
+		"or a <a class=\"dlkey\" href=\"install/linux.sh?token=" +
+		encodeURIComponent(pending["token"]) + "\">Linux install script</a> " +
+		"(available once, until " + exp.toLocaleTimeString() + ")");
+	t.eq(1).find("a.showkey").on("click.show", revealFunc(slotid));
+	t.eq(1).find("a.dlkey").on("click.show", function() {
+		clearPendingKey(slotid);
+		// Let the download start before the link is removed
+		setTimeout(function() {
+			t.eq(1).html("Downloaded");
+		}, 0);
+	});
+}
+
+function revealFunc(slotid) {
+	return function() {
+		var pending = pendingKey(slotid);
+		t = $("#" + slotid).find("td");
+		t.eq(1).find("a").off("click.show");
+		if (pending === undefined) {
+			t.eq(1).html("Assigned");
+			return;
+		}
+		$.ajax({
+			url: "/key/" + encodeURIComponent(pending["token"]),
+			dataType: "json",
+			success: function(data) {
+				clearPendingKey(slotid);
+				t.eq(1).text(data["key"]);
+			},
+			error: function(xhr, status, error) {
+				clearPendingKey(slotid);
+				showError(xhr, status, error);
+				loadKeys();
 			}
 		});
 	}
@@ -83,20 +228,109 @@ function generateFunc(slotid) {
 
 function showInitialKey(data, textstat, xhr) {
 	var slotid = ldrToSlot(data["name"]);
-	var keyval = data["prefix"] + data["key"];
+	setPendingKey(slotid, data);
 	t = $("#" + slotid).find("td");
-	t.eq(1).html(keyval);
+	showPendingKey(slotid);
 	t.eq(2).html("Created");
 	t.eq(3).html("Created");
+	t.eq(4).html("Not enrolled");
 }
 
 function loadKeys() {
-	for (var i = 1; i < 4; i++) {
+	for (var i = 1; i <= slotCount(); i++) {
 		var slotid = "slot" + i;
 		$("#" + slotid).find("td").eq(2).off("click.gen");
 		$("#" + slotid).find("td").eq(2).off("click.rem");
+		$("#" + slotid).find("td").eq(1).find("a").off("click.show");
 	}
-	$.ajax({url: "/keystatus", success: keyParser});
+	$.ajax({url: "/keystatus", success: function(data) {
+		keyParser(data);
+		overQuotaParser(data);
+	}, error: showError});
+}
+
+function logout() {
+	$.ajax({
+		url: "/logout",
+		type: "post",
+		dataType: "text",
+		headers: { "X-CSRF-Token": csrfToken() },
+		success: function() {
+			window.location.reload();
+		},
+		error: showError
+	});
+	return false;
+}
+
+function tokenDate(ts) {
+	if (ts === undefined || ts === null) {
+		return "Never";
+	}
+	return new Date(ts).toLocaleString();
+}
+
+function revokeTokenFunc(id) {
+	return function() {
+		$.ajax({
+			url: "/tokens/" + encodeURIComponent(id),
+			type: "delete",
+			headers: { "X-CSRF-Token": csrfToken() },
+			success: loadTokens,
+			error: showError
+		});
+	}
+}
+
+function tokenParser(data) {
+	var tb = $("#tokens");
+	tb.empty();
+	if (data.tokens.length == 0) {
+		tb.append($("<tr>").append($("<td>").text("No tokens")));
+		return;
+	}
+	for (var i = 0; i < data.tokens.length; i++) {
+		var tok = data.tokens[i];
+		var row = $("<tr>");
+		row.append($("<td>").text(tok["name"]));
+		row.append($("<td>").text(tok["scopes"].join(", ")));
+		row.append($("<td>").text(tokenDate(tok["created"])));
+		row.append($("<td>").text(tokenDate(tok["expires"])));
+		row.append($("<td>").text(tokenDate(tok["last_used"])));
+		var rev = $("<a href=\"#\">Revoke</a>").on("click", revokeTokenFunc(tok["id"]));
+		row.append($("<td>").append(rev));
+		tb.append(row);
+	}
+}
+
+function loadTokens() {
+	if ($("#tokens").length == 0) {
+		return;
+	}
+	$.ajax({url: "/tokens", dataType: "json", success: tokenParser, error: showError});
+}
+
+function createToken(e) {
+	e.preventDefault();
+	$.ajax({
+		url: "/tokens",
+		type: "post",
+		dataType: "json",
+		contentType: "application/json",
+		headers: { "X-CSRF-Token": csrfToken() },
+		data: JSON.stringify({
+			"name": $("#tokenname").val(),
+			"scopes": [ $("#tokenscope").val() ],
+			"days": parseInt($("#tokendays").val())
+		}),
+		success: function(data) {
+			$("#tokenname").val("");
+			$("#newtoken").text("Your new token is " + data["token"] +
+				" - copy it now, as it will not be shown again.");
+			loadTokens();
+		},
+		error: showError
+	});
 }
 
 function osDetails() {
@@ -110,4 +344,7 @@ function osDetails() {
 $(document).ready(function() {
 	osDetails();
 	loadKeys();
+	$("#logout").click(logout);
+	$("#tokenform").submit(createToken);
+	loadTokens();
 });
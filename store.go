@@ -0,0 +1,243 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Configuration for the state shared between portal instances, such as the locks
+// used to serialize key operations. With the memory backend state is kept in the
+// process, which is only suitable for a single instance; to run more than one
+// instance use the redis backend.
+type stateConfig struct {
+	Backend        string        // memory (the default) or redis
+	RedisAddress   string        // Address of the redis server, host:port
+	RedisPassword  string        // Password for the redis server, if required
+	RedisDB        int           // Redis database number
+	KeyPrefix      string        // Prefix for keys stored in redis, default migss:
+	LockWait       time.Duration // How long to wait for a lock before giving up
+	LockTTL        time.Duration // How long a lock is held if it is not released
+	IdempotencyTTL time.Duration // How long responses are kept for replay
+}
+
+const (
+	defaultKeyPrefix      = "migss:"
+	defaultLockWait       = 30 * time.Second
+	defaultLockTTL        = 2 * time.Minute
+	defaultIdempotencyTTL = 10 * time.Minute
+)
+
+func (s stateConfig) withDefaults() stateConfig {
+	if s.KeyPrefix == "" {
+		s.KeyPrefix = defaultKeyPrefix
+	}
+	if s.LockWait == 0 {
+		s.LockWait = defaultLockWait
+	}
+	if s.LockTTL == 0 {
+		s.LockTTL = defaultLockTTL
+	}
+	if s.IdempotencyTTL == 0 {
+		s.IdempotencyTTL = defaultIdempotencyTTL
+	}
+	return s
+}
+
+// Returned if a lock could not be acquired before the wait time expired
+var errLockTimeout = fmt.Errorf("timed out waiting for lock")
+
+// A store for state shared between portal instances
+type stateStore interface {
+	// Acquire the named lock, waiting up to wait for it to become available. If
+	// the lock is not released it expires after ttl.
+	lock(name string, ttl time.Duration, wait time.Duration) (release func(), err error)
+	// Return the value stored for key, or found false if there is no value
+	get(key string) (value string, found bool, err error)
+	// Store value for key, expiring after ttl
+	set(key string, value string, ttl time.Duration) error
+	// Take a token from each of the token buckets, only if all of them hold one.
+	// If any bucket is empty nothing is taken, limited is the index of the first
+	// empty bucket and wait is the time until it will hold a token; otherwise
+	// limited is -1.
+	take(buckets []tokenBucket) (limited int, wait time.Duration, err error)
+}
+
+// A token bucket, holding up to burst tokens and refilled at rate tokens per second
+type tokenBucket struct {
+	key   string
+	rate  float64
+	burst int
+}
+
+var (
+	stateConf            = stateConfig{}.withDefaults()
+	shared    stateStore = newMemoryStore()
+)
+
+// Initialize the shared state store from the configuration
+func stateInit(conf stateConfig) error {
+	stateConf = conf.withDefaults()
+	switch stateConf.Backend {
+	case "", "memory":
+		shared = newMemoryStore()
+	case "redis":
+		if stateConf.RedisAddress == "" {
+			return fmt.Errorf("redis state backend requires RedisAddress")
+		}
+		shared = newRedisStore(stateConf)
+	default:
+		return fmt.Errorf("unknown state backend %q", stateConf.Backend)
+	}
+	return nil
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	rate    float64
+	burst   int
+}
+
+// A lock held in memory; refs counts the holders and waiters, so the lock can be
+// removed once nobody is using it
+type memoryLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+type memoryValue struct {
+	value   string
+	expires time.Time
+}
+
+// A store that keeps state in memory
+type memoryStore struct {
+	sync.Mutex
+	values  map[string]memoryValue
+	locks   map[string]*memoryLock
+	buckets map[string]memoryBucket
+	swept   time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		values:  make(map[string]memoryValue),
+		locks:   make(map[string]*memoryLock),
+		buckets: make(map[string]memoryBucket),
+	}
+}
+
+// Locks are held by the process, so ttl is not needed and is ignored
+func (m *memoryStore) lock(name string, ttl time.Duration, wait time.Duration) (func(), error) {
+	m.Lock()
+	l, ok := m.locks[name]
+	if !ok {
+		l = &memoryLock{ch: make(chan struct{}, 1)}
+		m.locks[name] = l
+	}
+	l.refs++
+	m.Unlock()
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case l.ch <- struct{}{}:
+	case <-t.C:
+		m.unref(name, l)
+		return nil, errLockTimeout
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.ch
+			m.unref(name, l)
+		})
+	}, nil
+}
+
+// Drop a reference to a lock, removing it if it is no longer in use
+func (m *memoryStore) unref(name string, l *memoryLock) {
+	m.Lock()
+	defer m.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(m.locks, name)
+	}
+}
+
+func (m *memoryStore) get(key string) (string, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	v, ok := m.values[key]
+	if !ok {
+		return "", false, nil
+	}
+	if time.Now().After(v.expires) {
+		delete(m.values, key)
+		return "", false, nil
+	}
+	return v.value, true, nil
+}
+
+func (m *memoryStore) set(key string, value string, ttl time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	// Remove expired values as new ones are added so the map does not grow
+	for k, v := range m.values {
+		if now.After(v.expires) {
+			delete(m.values, k)
+		}
+	}
+	m.values[key] = memoryValue{value: value, expires: now.Add(ttl)}
+	return nil
+}
+
+func (m *memoryStore) take(buckets []tokenBucket) (int, time.Duration, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	// Buckets that have been idle long enough to refill hold nothing that needs
+	// to be kept, so they are removed periodically
+	if now.Sub(m.swept) > time.Minute {
+		for k, b := range m.buckets {
+			if now.Sub(b.updated).Seconds()*b.rate >= float64(b.burst) {
+				delete(m.buckets, k)
+			}
+		}
+		m.swept = now
+	}
+	state := make([]memoryBucket, len(buckets))
+	limited := -1
+	for i, tb := range buckets {
+		b, ok := m.buckets[tb.key]
+		if !ok {
+			b.tokens = float64(tb.burst)
+		} else {
+			b.tokens = math.Min(float64(tb.burst), b.tokens+now.Sub(b.updated).Seconds()*tb.rate)
+		}
+		b.updated = now
+		b.rate = tb.rate
+		b.burst = tb.burst
+		state[i] = b
+		if b.tokens < 1 && limited == -1 {
+			limited = i
+		}
+	}
+	for i, tb := range buckets {
+		if limited == -1 {
+			state[i].tokens--
+		}
+		m.buckets[tb.key] = state[i]
+	}
+	if limited != -1 {
+		return limited, bucketWait(state[limited].tokens, buckets[limited].rate), nil
+	}
+	return -1, 0, nil
+}
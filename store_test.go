@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Locks are removed from the memory store once they are no longer held or waited for
+func TestMemoryStoreLocks(t *testing.T) {
+	m := newMemoryStore()
+	release, err := m.lock("user:a", time.Minute, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.lock("user:a", time.Minute, 10*time.Millisecond)
+	if err != errLockTimeout {
+		t.Fatalf("lock held twice: %v", err)
+	}
+	if len(m.locks) != 1 {
+		t.Fatalf("%v locks while held", len(m.locks))
+	}
+
+	acquired := make(chan func())
+	go func() {
+		r, err := m.lock("user:a", time.Minute, time.Second)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- r
+	}()
+	time.Sleep(10 * time.Millisecond)
+	release()
+	release()
+	r := <-acquired
+	if len(m.locks) != 1 {
+		t.Fatalf("%v locks while held by a waiter", len(m.locks))
+	}
+	r()
+	if len(m.locks) != 0 {
+		t.Fatalf("%v locks remain after release", len(m.locks))
+	}
+}
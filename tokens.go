@@ -0,0 +1,438 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// Personal access tokens let scripts and the migss client use the portal on behalf
+// of a user, by sending the token in an Authorization: Bearer header. Tokens are
+// kept in the shared state store; only a hash of each token is stored, so a token
+// is shown to the user once, when it is created. Tokens must outlive the portal
+// process, so they can only be enabled with the redis state backend.
+
+// Configuration for personal access tokens
+type tokenConfig struct {
+	Enabled     bool          // Turn on personal access tokens; requires the redis state backend
+	MaxLifetime time.Duration // Longest lifetime a token can be created with
+	MaxTokens   int           // Most tokens a user can hold at once
+}
+
+const (
+	defaultTokenMaxLifetime = 90 * 24 * time.Hour
+	defaultMaxTokens        = 10
+)
+
+func (t tokenConfig) withDefaults() tokenConfig {
+	if t.MaxLifetime == 0 {
+		t.MaxLifetime = defaultTokenMaxLifetime
+	}
+	if t.MaxTokens == 0 {
+		t.MaxTokens = defaultMaxTokens
+	}
+	return t
+}
+
+// Check personal access tokens can be used with the state store configuration
+func tokensInit() error {
+	if cfg.Tokens.Enabled && stateConf.Backend != "redis" {
+		return fmt.Errorf("personal access tokens require the redis state backend, " +
+			"tokens kept in memory would be lost on restart")
+	}
+	return nil
+}
+
+// Wraps the handlers for managing tokens, rejecting requests if tokens are not enabled
+func tokensEnabled(h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if !cfg.Tokens.Enabled {
+			writeError(rw, req, errNotFound("access tokens are not enabled", nil))
+			return
+		}
+		h(rw, req)
+	}
+}
+
+// Scopes a token can be granted. A token with the keys scope can also do anything a
+// token with the status scope can.
+const (
+	scopeStatus = "status" // View slots and keys
+	scopeKeys   = "keys"   // Issue, retrieve and disable keys
+)
+
+// Prefix of every token, so tokens are easily recognised
+const tokenPrefix = "migss_"
+
+type accessTokenKeyType int
+
+// Context key holding the token used to authenticate a request
+const accessTokenKey accessTokenKeyType = 0
+
+// A personal access token. Hash is only kept in the store and never returned.
+type accessToken struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  time.Time  `json:"expires"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Hash     string     `json:"hash,omitempty"`
+}
+
+// Returns true if the token grants scope
+func (a *accessToken) allows(scope string) bool {
+	for _, x := range a.Scopes {
+		if x == scope || x == scopeKeys {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Return the tokens held by user that have not expired
+func userTokens(user string) ([]accessToken, error) {
+	ret := make([]accessToken, 0)
+	v, found, err := shared.get("tokens:" + user)
+	if err != nil || !found {
+		return ret, err
+	}
+	var all []accessToken
+	err = json.Unmarshal([]byte(v), &all)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, x := range all {
+		if now.Before(x.Expires) {
+			ret = append(ret, x)
+		}
+	}
+	return ret, nil
+}
+
+// Store the tokens held by user, which must be called with the user's token lock
+// held. The value is kept until the last of the tokens expires.
+func saveUserTokens(user string, toks []accessToken) error {
+	ttl := time.Minute
+	for _, x := range toks {
+		if d := time.Until(x.Expires); d > ttl {
+			ttl = d
+		}
+	}
+	buf, err := json.Marshal(toks)
+	if err != nil {
+		return err
+	}
+	return shared.set("tokens:"+user, string(buf), ttl)
+}
+
+// Lock the tokens held by user so they can be changed
+func lockUserTokens(user string) (func(), error) {
+	release, err := shared.lock("tokens:"+user, stateConf.LockTTL, stateConf.LockWait)
+	if err == errLockTimeout {
+		return nil, errConflict("another token operation is in progress, please try again", err)
+	} else if err != nil {
+		return nil, errUnavailable("tokens are currently unavailable, please try again later", err)
+	}
+	return release, nil
+}
+
+// Create a token for user, returning the token and its details
+func createToken(user string, name string, scopes []string, lifetime time.Duration) (string, accessToken, error) {
+	var tok accessToken
+	conf := cfg.Tokens.withDefaults()
+	if name == "" || len(name) > 100 {
+		return "", tok, errBadRequest("a token name of up to 100 characters is required", nil)
+	}
+	if len(scopes) == 0 {
+		return "", tok, errBadRequest("at least one scope is required", nil)
+	}
+	for _, x := range scopes {
+		if x != scopeStatus && x != scopeKeys {
+			return "", tok, errBadRequest(fmt.Sprintf("unknown scope %q", x), nil)
+		}
+	}
+	if lifetime <= 0 || lifetime > conf.MaxLifetime {
+		return "", tok, errBadRequest(fmt.Sprintf("token lifetime must be between 1 and %.0f days",
+			conf.MaxLifetime.Hours()/24), nil)
+	}
+
+	release, err := lockUserTokens(user)
+	if err != nil {
+		return "", tok, err
+	}
+	defer release()
+	toks, err := userTokens(user)
+	if err != nil {
+		return "", tok, errUnavailable("tokens are currently unavailable, please try again later", err)
+	}
+	if len(toks) >= conf.MaxTokens {
+		return "", tok, errConflict(fmt.Sprintf("you can hold at most %v tokens, revoke one first", conf.MaxTokens), nil)
+	}
+	tok.ID, err = randomString(12)
+	if err != nil {
+		return "", tok, errInternal(err)
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", tok, errInternal(err)
+	}
+	token := tokenPrefix + tok.ID + "." + secret
+	now := time.Now().UTC()
+	tok.Name = name
+	tok.Scopes = scopes
+	tok.Created = now
+	tok.Expires = now.Add(lifetime)
+	tok.Hash = tokenHash(token)
+	// The token ID leads to the user, so a token can be checked without knowing
+	// who it belongs to
+	err = shared.set("token:"+tok.ID, user, lifetime)
+	if err == nil {
+		err = saveUserTokens(user, append(toks, tok))
+	}
+	if err != nil {
+		return "", tok, errUnavailable("tokens are currently unavailable, please try again later", err)
+	}
+	tok.Hash = ""
+	return token, tok, nil
+}
+
+// Revoke the token with id held by user
+func revokeToken(user string, id string) (accessToken, error) {
+	release, err := lockUserTokens(user)
+	if err != nil {
+		return accessToken{}, err
+	}
+	defer release()
+	toks, err := userTokens(user)
+	if err != nil {
+		return accessToken{}, errUnavailable("tokens are currently unavailable, please try again later", err)
+	}
+	for i, x := range toks {
+		if x.ID != id {
+			continue
+		}
+		err = saveUserTokens(user, append(toks[:i], toks[i+1:]...))
+		if err != nil {
+			return x, errUnavailable("tokens are currently unavailable, please try again later", err)
+		}
+		return x, nil
+	}
+	return accessToken{}, errNotFound("no such token", nil)
+}
+
+// Revoke all of the tokens held by user, returning the tokens that were revoked
+func revokeUserTokens(user string) ([]accessToken, error) {
+	release, err := lockUserTokens(user)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	toks, err := userTokens(user)
+	if err != nil {
+		return nil, errUnavailable("tokens are currently unavailable, please try again later", err)
+	}
+	if len(toks) == 0 {
+		return toks, nil
+	}
+	err = saveUserTokens(user, []accessToken{})
+	if err != nil {
+		return nil, errUnavailable("tokens are currently unavailable, please try again later", err)
+	}
+	return toks, nil
+}
+
+// Return the user and token details for token, if it is valid
+func checkToken(token string) (string, accessToken, error) {
+	var tok accessToken
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return "", tok, fmt.Errorf("malformed token")
+	}
+	id := strings.SplitN(strings.TrimPrefix(token, tokenPrefix), ".", 2)[0]
+	user, found, err := shared.get("token:" + id)
+	if err != nil {
+		return "", tok, err
+	}
+	if !found {
+		return "", tok, fmt.Errorf("unknown token %v", id)
+	}
+	toks, err := userTokens(user)
+	if err != nil {
+		return "", tok, err
+	}
+	for _, x := range toks {
+		if x.ID != id {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(x.Hash), []byte(tokenHash(token))) != 1 {
+			return user, tok, fmt.Errorf("invalid token %v", id)
+		}
+		x.Hash = ""
+		return user, x, nil
+	}
+	return user, tok, fmt.Errorf("token %v has expired or been revoked", id)
+}
+
+// Return the bearer token in the request, or found false if there isn't one
+func bearerToken(req *http.Request) (string, bool) {
+	v := req.Header.Get("Authorization")
+	if len(v) < 7 || !strings.EqualFold(v[:7], "bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(v[7:]), true
+}
+
+// Authenticate a request carrying a bearer token, for a route requiring scope. An
+// empty scope means the route can't be used with a token. Returns the user the
+// token belongs to, or false if the request has been rejected.
+func tokenAuth(rw http.ResponseWriter, req *http.Request, token string, scope string) (string, bool) {
+	if !cfg.Tokens.Enabled {
+		writeError(rw, req, errUnauthorized("access tokens are not enabled", nil))
+		return "", false
+	}
+	user, tok, err := checkToken(token)
+	ev := newAuditEvent(req, user, auditTokenUse)
+	ev.TokenID = tok.ID
+	ev.Reason = req.Method + " " + routePath(req)
+	if err != nil {
+		ev.Action = auditAuthFailure
+		auditor.failure(ev, err)
+		writeError(rw, req, errUnauthorized("the access token is not valid", err))
+		return "", false
+	}
+	if scope == "" || !tok.allows(scope) {
+		auditor.failure(ev, fmt.Errorf("token does not have scope %q", scope))
+		writeError(rw, req, errForbidden("the access token can't be used for this request", nil))
+		return "", false
+	}
+	auditor.success(ev)
+	context.Set(req, accessTokenKey, tok)
+	// Recording when the token was last used is informational, so errors are ignored
+	shared.set("tokenused:"+tok.ID, time.Now().UTC().Format(time.RFC3339), time.Until(tok.Expires))
+	return user, true
+}
+
+// Returns true if the request was authenticated using an access token
+func isTokenRequest(req *http.Request) bool {
+	_, ok := context.Get(req, accessTokenKey).(accessToken)
+	return ok
+}
+
+// Payload submitted to create a token
+type tokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	Days   int      `json:"days"`
+}
+
+// Response to a token creation request; the token is only ever returned here
+type tokenReply struct {
+	Token  string      `json:"token"`
+	Detail accessToken `json:"detail"`
+}
+
+type tokensReply struct {
+	Tokens []accessToken `json:"tokens"`
+}
+
+func handleListTokens(rw http.ResponseWriter, req *http.Request) {
+	rdetails, err := newRequestDetails(req)
+	if err != nil {
+		writeError(rw, req, errUnauthorized("no valid identity for request", err))
+		return
+	}
+	toks, err := userTokens(rdetails.remoteUser)
+	if err != nil {
+		writeError(rw, req, errUnavailable("tokens are currently unavailable, please try again later", err))
+		return
+	}
+	for i := range toks {
+		toks[i].Hash = ""
+		v, found, err := shared.get("tokenused:" + toks[i].ID)
+		if err != nil || !found {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			toks[i].LastUsed = &t
+		}
+	}
+	buf, err := json.Marshal(&tokensReply{Tokens: toks})
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Write(buf)
+}
+
+func handleCreateToken(rw http.ResponseWriter, req *http.Request) {
+	var treq tokenRequest
+
+	rdetails, err := newRequestDetails(req)
+	if err != nil {
+		writeError(rw, req, errUnauthorized("no valid identity for request", err))
+		return
+	}
+	err = json.NewDecoder(req.Body).Decode(&treq)
+	if err != nil {
+		writeError(rw, req, errBadRequest("invalid request", err))
+		return
+	}
+	ev := newAuditEvent(req, rdetails.remoteUser, auditTokenCreate)
+	token, tok, err := createToken(rdetails.remoteUser, treq.Name, treq.Scopes,
+		time.Duration(treq.Days)*24*time.Hour)
+	ev.TokenID = tok.ID
+	if err != nil {
+		auditor.failure(ev, err)
+		writeError(rw, req, err)
+		return
+	}
+	ev.Reason = "scopes " + strings.Join(tok.Scopes, ",")
+	auditor.success(ev)
+	buf, err := json.Marshal(&tokenReply{Token: token, Detail: tok})
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Write(buf)
+}
+
+func handleRevokeToken(rw http.ResponseWriter, req *http.Request) {
+	rdetails, err := newRequestDetails(req)
+	if err != nil {
+		writeError(rw, req, errUnauthorized("no valid identity for request", err))
+		return
+	}
+	ev := newAuditEvent(req, rdetails.remoteUser, auditTokenRevoke)
+	ev.TokenID = mux.Vars(req)["id"]
+	_, err = revokeToken(rdetails.remoteUser, ev.TokenID)
+	if err != nil {
+		auditor.failure(ev, err)
+		writeError(rw, req, err)
+		return
+	}
+	auditor.success(ev)
+	rw.WriteHeader(http.StatusNoContent)
+}
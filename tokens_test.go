@@ -0,0 +1,142 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Enable tokens for the duration of the test
+func useTokens(t *testing.T, enabled bool) {
+	old := cfg.Tokens
+	cfg.Tokens.Enabled = enabled
+	t.Cleanup(func() { cfg.Tokens = old })
+}
+
+// An audit sink keeping events in memory
+type memoryAuditSink struct {
+	events []auditEvent
+}
+
+func (m *memoryAuditSink) write(buf []byte) error {
+	var ev auditEvent
+	if err := json.Unmarshal(buf, &ev); err != nil {
+		return err
+	}
+	m.events = append(m.events, ev)
+	return nil
+}
+
+func useMemoryAudit(t *testing.T) *memoryAuditSink {
+	m := &memoryAuditSink{}
+	old := auditor.sinks
+	auditor.sinks = []auditSink{m}
+	t.Cleanup(func() { auditor.sinks = old })
+	return m
+}
+
+// Tokens are lost on restart with the memory backend, so can't be enabled with it
+func TestTokensInit(t *testing.T) {
+	old := stateConf
+	t.Cleanup(func() { stateConf = old })
+	tests := []struct {
+		enabled bool
+		backend string
+		ok      bool
+	}{
+		{false, "memory", true},
+		{true, "memory", false},
+		{true, "redis", true},
+	}
+	for _, tt := range tests {
+		useTokens(t, tt.enabled)
+		stateConf.Backend = tt.backend
+		if err := tokensInit(); (err == nil) != tt.ok {
+			t.Errorf("tokens enabled %v with %v backend: got %v", tt.enabled, tt.backend, err)
+		}
+	}
+}
+
+func TestTokensNotEnabled(t *testing.T) {
+	useMemoryStore(t)
+	useTokens(t, false)
+	r := mux.NewRouter()
+	r.HandleFunc("/tokens", setContext(tokensEnabled(handleListTokens))).Methods("GET")
+	r.HandleFunc("/keystatus", setTokenContext(scopeStatus, handleKeyStatus)).Methods("GET")
+	rw := serveAs(t, r, "user@example.com", "GET", "/tokens", "")
+	if rw.Code != 404 {
+		t.Fatalf("list tokens: got %v %v", rw.Code, rw.Body.String())
+	}
+	rw = serveAs(t, r, "", "GET", "/keystatus", "", "Authorization", "Bearer sometoken")
+	if rw.Code != 401 {
+		t.Fatalf("request with a token: got %v %v", rw.Code, rw.Body.String())
+	}
+}
+
+// The token used to retrieve a key is not written to the audit log
+func TestTokenAuditPath(t *testing.T) {
+	useMemoryStore(t)
+	useTokens(t, true)
+	m := useMemoryAudit(t)
+	r := mux.NewRouter()
+	r.HandleFunc("/key/{token}", setTokenContext(scopeKeys, handleGetKey)).Methods("GET")
+	rw := serveAs(t, r, "", "GET", "/key/secretkeytoken", "", "Authorization", "Bearer sometoken")
+	if rw.Code != 401 {
+		t.Fatalf("key retrieval with an invalid token: got %v %v", rw.Code, rw.Body.String())
+	}
+	if len(m.events) != 1 || m.events[0].Reason != "GET /key/{token}" {
+		t.Fatalf("audit events: got %+v", m.events)
+	}
+	for _, ev := range m.events {
+		if buf, _ := json.Marshal(ev); strings.Contains(string(buf), "secretkeytoken") {
+			t.Fatalf("audit event holds the key token: %s", buf)
+		}
+	}
+}
+
+// Requests authenticated with a valid access token are exempt from the CSRF checks,
+// but a bearer header alone does not exempt a request
+func TestTokenCSRFExemption(t *testing.T) {
+	useMemoryStore(t)
+	useTokens(t, true)
+	useCSRFKey(t)
+	token, _, err := createToken("user@example.com", "ci", []string{scopeKeys}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := func(http.ResponseWriter, *http.Request) {}
+	r := mux.NewRouter()
+	r.HandleFunc("/newkey", setTokenContext(scopeKeys, csrfProtect(h))).Methods("POST")
+	r.HandleFunc("/tokens", setContext(tokensEnabled(csrfProtect(h)))).Methods("POST")
+	tests := []struct {
+		name string
+		user string
+		path string
+		auth string
+		code int
+	}{
+		{"valid token", "", "/newkey", "Bearer " + token, 200},
+		{"invalid token", "", "/newkey", "Bearer " + token + "x", 401},
+		{"session without a CSRF token", "user@example.com", "/newkey", "", 403},
+		{"token on a route not accepting tokens", "user@example.com", "/tokens", "Bearer " + token, 403},
+	}
+	for _, tt := range tests {
+		var hdr []string
+		if tt.auth != "" {
+			hdr = []string{"Authorization", tt.auth}
+		}
+		rw := serveAs(t, r, tt.user, "POST", tt.path, "", hdr...)
+		if rw.Code != tt.code {
+			t.Errorf("%v: got %v %v", tt.name, rw.Code, rw.Body.String())
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mozilla/mig"
+)
+
+// Newly issued keys are not returned to the browser directly. Instead the key is
+// kept in the vault and a token is returned, which the user can exchange for the key
+// once within the retrieval window. Keys are encrypted with a key generated when the
+// portal starts and held only in memory, so a token can only be redeemed on the
+// instance that issued it, and pending keys are lost if the portal restarts.
+
+// How long a newly issued key can be retrieved if KeyRetrievalTTL is not set
+const defaultKeyRetrievalTTL = 10 * time.Minute
+
+// Returned if a token does not exist, has expired or has already been redeemed
+var errVaultToken = fmt.Errorf("key retrieval token not found")
+
+type vaultEntry struct {
+	owner   string
+	sealed  []byte
+	expires time.Time
+}
+
+// The part of a loader entry kept in the vault
+type vaultSecret struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	Key    string `json:"key"`
+}
+
+type keyVault struct {
+	sync.Mutex
+	aead    cipher.AEAD
+	ttl     time.Duration
+	entries map[string]vaultEntry
+}
+
+var vault *keyVault
+
+func newKeyVault(ttl time.Duration) (*keyVault, error) {
+	if ttl == 0 {
+		ttl = defaultKeyRetrievalTTL
+	}
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &keyVault{aead: aead, ttl: ttl, entries: make(map[string]vaultEntry)}, nil
+}
+
+// Initialize the vault from the configuration
+func vaultInit() (err error) {
+	vault, err = newKeyVault(cfg.KeyRetrievalTTL)
+	return
+}
+
+// Entries are indexed by a hash of the token, so the tokens themselves are not kept
+func vaultIndex(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Store the key for le, returning a token that owner can use to retrieve it
+func (v *keyVault) put(owner string, le mig.LoaderEntry) (string, time.Time, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	buf, err := json.Marshal(&vaultSecret{Name: le.Name, Prefix: le.Prefix, Key: le.Key})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	nonce := make([]byte, v.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	idx := vaultIndex(token)
+	// The index and owner are authenticated with the key, so an entry can't be
+	// moved to another token or user
+	sealed := v.aead.Seal(nonce, nonce, buf, []byte(idx+"\n"+owner))
+
+	v.Lock()
+	defer v.Unlock()
+	now := time.Now()
+	for k, e := range v.entries {
+		if now.After(e.expires) {
+			delete(v.entries, k)
+		}
+	}
+	expires := now.Add(v.ttl)
+	v.entries[idx] = vaultEntry{owner: owner, sealed: sealed, expires: expires}
+	return token, expires, nil
+}
+
+// Retrieve the key stored for token, which must have been issued to owner. The
+// token can only be redeemed once.
+func (v *keyVault) take(owner string, token string) (mig.LoaderEntry, error) {
+	var le mig.LoaderEntry
+	idx := vaultIndex(token)
+	v.Lock()
+	e, ok := v.entries[idx]
+	if ok && e.owner == owner {
+		delete(v.entries, idx)
+	}
+	v.Unlock()
+	if !ok || e.owner != owner || time.Now().After(e.expires) {
+		return le, errVaultToken
+	}
+	ns := v.aead.NonceSize()
+	buf, err := v.aead.Open(nil, e.sealed[:ns], e.sealed[ns:], []byte(idx+"\n"+owner))
+	if err != nil {
+		return le, err
+	}
+	var s vaultSecret
+	err = json.Unmarshal(buf, &s)
+	if err != nil {
+		return le, err
+	}
+	le.Name = s.Name
+	le.Prefix = s.Prefix
+	le.Key = s.Key
+	return le, nil
+}
+
+// Response to a new key request; the key is retrieved using the token
+type newkeyReply struct {
+	Name    string    `json:"name"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// Response to a key retrieval request
+type keyReply struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// Redeem token for the key it was issued for, if it was issued to the user making
+// the request
+func redeemKeyToken(req *http.Request, token string) (mig.LoaderEntry, error) {
+	rdetails, err := newRequestDetails(req)
+	if err != nil {
+		return mig.LoaderEntry{}, errUnauthorized("no valid identity for request", err)
+	}
+	le, err := vault.take(rdetails.remoteUser, token)
+	if err == errVaultToken {
+		return le, errNotFound("the key is no longer available; it may have already been "+
+			"retrieved or have expired, generate a new key for the slot", err)
+	} else if err != nil {
+		return le, errInternal(err)
+	}
+	return le, nil
+}
+
+func handleGetKey(rw http.ResponseWriter, req *http.Request) {
+	le, err := redeemKeyToken(req, mux.Vars(req)["token"])
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+	buf, err := json.Marshal(&keyReply{Name: le.Name, Key: le.Prefix + le.Key})
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(rw, string(buf))
+}
+
+// The name of the file the loader reads its key from
+const loaderKeyFileName = "mig-loader.key"
+
+// Return the contents of the loader key file for le. The loader strips only spaces
+// from the file, so the file must not end with a newline.
+func loaderKeyFile(le mig.LoaderEntry) ([]byte, error) {
+	pk := le.Prefix + le.Key
+	err := mig.ValidateLoaderPrefixAndKey(pk)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key for loader %v: %v", le.Name, err)
+	}
+	return []byte(pk), nil
+}
+
+// Serve the key for the token in the request as a mig-loader.key file
+func handleDownloadKey(rw http.ResponseWriter, req *http.Request) {
+	le, err := redeemKeyToken(req, mux.Vars(req)["token"])
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+	buf, err := loaderKeyFile(le)
+	if err != nil {
+		writeError(rw, req, errInternal(err))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Disposition", "attachment; filename=\""+loaderKeyFileName+"\"")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.Write(buf)
+}
@@ -0,0 +1,135 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Aaron Meihm ameihm@mozilla.com [:alm]
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla/mig"
+)
+
+func TestKeyVault(t *testing.T) {
+	v, err := newKeyVault(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := mig.LoaderEntry{Name: "migss-user@example.com-1", Prefix: "abcdefgh", Key: "secretkey"}
+	token, _, err := v.put("user@example.com", le)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range v.entries {
+		if strings.Contains(string(e.sealed), le.Key) {
+			t.Fatal("vault entry holds the key in the clear")
+		}
+	}
+
+	// A token issued to one user can't be redeemed by another, and the attempt
+	// does not consume it
+	if _, err := v.take("other@example.com", token); err != errVaultToken {
+		t.Fatalf("take by another user: got %v", err)
+	}
+	got, err := v.take("user@example.com", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != le.Name || got.Prefix != le.Prefix || got.Key != le.Key {
+		t.Fatalf("take: got %+v", got)
+	}
+	// The token can only be redeemed once, and the key is gone once retrieved
+	if _, err := v.take("user@example.com", token); err != errVaultToken {
+		t.Fatalf("second take: got %v", err)
+	}
+	if len(v.entries) != 0 {
+		t.Fatalf("%v entries left after retrieval", len(v.entries))
+	}
+	if _, err := v.take("user@example.com", "unknown"); err != errVaultToken {
+		t.Fatalf("take with unknown token: got %v", err)
+	}
+}
+
+func TestKeyVaultExpiry(t *testing.T) {
+	v, err := newKeyVault(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := mig.LoaderEntry{Name: "migss-user@example.com-1", Prefix: "abcdefgh", Key: "secretkey"}
+	expired, _, err := v.put("user@example.com", le)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := vaultIndex(expired)
+	e := v.entries[idx]
+	e.expires = time.Now().Add(-time.Second)
+	v.entries[idx] = e
+	if _, err := v.take("user@example.com", expired); err != errVaultToken {
+		t.Fatalf("take of expired token: got %v", err)
+	}
+
+	// Expired entries are removed when another key is stored
+	other, _, err := v.put("user@example.com", le)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = v.entries[vaultIndex(other)]
+	e.expires = time.Now().Add(-time.Second)
+	v.entries[vaultIndex(other)] = e
+	if _, _, err := v.put("user@example.com", le); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v.entries[vaultIndex(other)]; ok || len(v.entries) != 1 {
+		t.Fatalf("expired entries not removed: %v entries", len(v.entries))
+	}
+}
+
+// Keys are retrieved through the handlers once, by the user they were issued to,
+// and are never written to the state store
+func TestKeyRetrieval(t *testing.T) {
+	useMemoryBackend(t)
+	r := keyRouter(t)
+	user := "user@example.com"
+	m := shared.(*memoryStore)
+
+	rw := serveAs(t, r, user, "POST", "/newkey", `{"slot":"slot1"}`)
+	var reply newkeyReply
+	if rw.Code != 200 || json.Unmarshal(rw.Body.Bytes(), &reply) != nil {
+		t.Fatalf("newkey: got %v %v", rw.Code, rw.Body.String())
+	}
+	if strings.Contains(rw.Body.String(), `"key"`) {
+		t.Fatalf("newkey response holds the key: %v", rw.Body.String())
+	}
+
+	rw = serveAs(t, r, "other@example.com", "GET", "/key/"+reply.Token, "")
+	if rw.Code != 404 || errorCode(t, rw) != errCodeNotFound {
+		t.Fatalf("retrieval by another user: got %v %v", rw.Code, rw.Body.String())
+	}
+	rw = serveAs(t, r, user, "GET", "/key/"+reply.Token, "")
+	var kr keyReply
+	if rw.Code != 200 || json.Unmarshal(rw.Body.Bytes(), &kr) != nil {
+		t.Fatalf("key retrieval: got %v %v", rw.Code, rw.Body.String())
+	}
+	if rw.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("key retrieval Cache-Control: got %q", rw.Header().Get("Cache-Control"))
+	}
+	if err := mig.ValidateLoaderPrefixAndKey(kr.Key); err != nil {
+		t.Fatalf("invalid key %q: %v", kr.Key, err)
+	}
+	rw = serveAs(t, r, user, "GET", "/key/"+reply.Token, "")
+	if rw.Code != 404 || errorCode(t, rw) != errCodeNotFound {
+		t.Fatalf("second retrieval: got %v %v", rw.Code, rw.Body.String())
+	}
+	for k, v := range m.values {
+		if strings.Contains(v.value, kr.Key[8:]) {
+			t.Fatalf("state store value %v holds the key", k)
+		}
+	}
+	if len(vault.entries) != 0 {
+		t.Fatalf("%v vault entries left after retrieval", len(vault.entries))
+	}
+}